@@ -17,11 +17,28 @@ type atomicUint32 struct {
 	v uint32
 }
 
+type atomicInt64 struct {
+	_ noCopy
+	v int64
+}
+
+type atomicUint64 struct {
+	_ noCopy
+	v uint64
+}
+
 type atomicPointer[T any] struct {
 	_   noCopy
 	ptr unsafe.Pointer
 }
 
+// markablePointer is an atomic pointer which additionally carries a mark flag in its lowest bit
+// pointer and mark are always loaded and updated together in a single atomic operation
+type markablePointer[T any] struct {
+	_   noCopy
+	ptr unsafe.Pointer
+}
+
 type atomicUintptr struct {
 	_   noCopy
 	ptr uintptr
@@ -35,6 +52,22 @@ func (u *atomicUint32) CompareAndSwap(old, new uint32) bool {
 	return atomic.CompareAndSwapUint32(&u.v, old, new)
 }
 
+func (i *atomicInt64) Load() int64           { return atomic.LoadInt64(&i.v) }
+func (i *atomicInt64) Store(v int64)         { atomic.StoreInt64(&i.v, v) }
+func (i *atomicInt64) Add(delta int64) int64 { return atomic.AddInt64(&i.v, delta) }
+func (i *atomicInt64) Swap(v int64) int64    { return atomic.SwapInt64(&i.v, v) }
+func (i *atomicInt64) CompareAndSwap(old, new int64) bool {
+	return atomic.CompareAndSwapInt64(&i.v, old, new)
+}
+
+func (u *atomicUint64) Load() uint64            { return atomic.LoadUint64(&u.v) }
+func (u *atomicUint64) Store(v uint64)          { atomic.StoreUint64(&u.v, v) }
+func (u *atomicUint64) Add(delta uint64) uint64 { return atomic.AddUint64(&u.v, delta) }
+func (u *atomicUint64) Swap(v uint64) uint64    { return atomic.SwapUint64(&u.v, v) }
+func (u *atomicUint64) CompareAndSwap(old, new uint64) bool {
+	return atomic.CompareAndSwapUint64(&u.v, old, new)
+}
+
 func (p *atomicPointer[T]) Load() *T     { return (*T)(atomic.LoadPointer(&p.ptr)) }
 func (p *atomicPointer[T]) Store(v *T)   { atomic.StorePointer(&p.ptr, unsafe.Pointer(v)) }
 func (p *atomicPointer[T]) Swap(v *T) *T { return (*T)(atomic.SwapPointer(&p.ptr, unsafe.Pointer(v))) }
@@ -49,3 +82,52 @@ func (u *atomicUintptr) Swap(v uintptr) uintptr    { return atomic.SwapUintptr(&
 func (u *atomicUintptr) CompareAndSwap(old, new uintptr) bool {
 	return atomic.CompareAndSwapUintptr(&u.ptr, old, new)
 }
+
+// markedNil is the marked representation of a nil pointer
+// the mark bit cannot be set on nil itself as 0x1 is not a valid pointer value
+var markedNil = unsafe.Pointer(new(uintptr))
+
+// mark returns the marked representation of an unmarked pointer
+func mark(p unsafe.Pointer) unsafe.Pointer {
+	if p == nil {
+		return markedNil
+	}
+	return unsafe.Pointer(uintptr(p) + 1)
+}
+
+// unmark returns the pointer without the mark bit along with the mark
+func unmark(p unsafe.Pointer) (unsafe.Pointer, bool) {
+	if p == markedNil {
+		return nil, true
+	}
+	return unsafe.Pointer(uintptr(p) &^ 1), uintptr(p)&1 == 1
+}
+
+func (p *markablePointer[T]) Load() *T {
+	ptr, _ := unmark(atomic.LoadPointer(&p.ptr))
+	return (*T)(ptr)
+}
+func (p *markablePointer[T]) IsMarked() bool {
+	_, marked := unmark(atomic.LoadPointer(&p.ptr))
+	return marked
+}
+func (p *markablePointer[T]) Store(v *T) { atomic.StorePointer(&p.ptr, unsafe.Pointer(v)) }
+
+// CompareAndSwap swaps the pointer only if it is unmarked and equal to `old`
+func (p *markablePointer[T]) CompareAndSwap(old, new *T) bool {
+	return atomic.CompareAndSwapPointer(&p.ptr, unsafe.Pointer(old), unsafe.Pointer(new))
+}
+
+// Mark sets the mark flag without modifying the pointer
+// returns `true` only for the call which actually set the flag
+func (p *markablePointer[T]) Mark() bool {
+	for {
+		old := atomic.LoadPointer(&p.ptr)
+		if _, marked := unmark(old); marked {
+			return false
+		}
+		if atomic.CompareAndSwapPointer(&p.ptr, old, mark(old)) {
+			return true
+		}
+	}
+}
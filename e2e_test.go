@@ -1,13 +1,25 @@
 package haxmap
 
 import (
+	"bytes"
+	"encoding/gob"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
 	"math"
+	"math/bits"
+	"math/rand"
+	"reflect"
+	"runtime"
+	"sort"
 	"strconv"
+	"strings"
 	"sync"
 	"sync/atomic"
 	"testing"
 	"time"
+	"unsafe"
 )
 
 type Animal struct {
@@ -151,6 +163,24 @@ func TestFillrate(t *testing.T) {
 	}
 }
 
+func TestFillRateFloat(t *testing.T) {
+	m := New[int, int](8)
+	if fr := m.FillRateFloat(); fr != 0 {
+		t.Errorf("FillRateFloat should be zero when the map is empty, fillrate: %v", fr)
+	}
+	m.Set(1, 1)
+	if fr := m.FillRateFloat(); fr != 0.125 {
+		t.Errorf("FillRateFloat should be 0.125 with one out of eight slots filled, fillrate: %v", fr)
+	}
+	if fr := m.Fillrate(); fr != 12 {
+		t.Errorf("Fillrate should be truncated to 12, fillrate: %v", fr)
+	}
+	m.metadata.Store(&metadata[int, int]{})
+	if fr := m.FillRateFloat(); fr != 0 {
+		t.Errorf("FillRateFloat should be zero for an index of length zero, fillrate: %v", fr)
+	}
+}
+
 func TestDelete(t *testing.T) {
 	m := New[int, *Animal]()
 	cat := &Animal{"cat"}
@@ -432,3 +462,3735 @@ func TestSwap(t *testing.T) {
 		t.Error("New value not set")
 	}
 }
+
+func TestPendingDeletions(t *testing.T) {
+	m := New[int, int]()
+	for i := 0; i < 10; i++ {
+		m.Set(i, i)
+	}
+	if n := m.PendingDeletions(); n != 0 {
+		t.Errorf("no deletions should be pending, got %d", n)
+	}
+	m.Del(5)
+	if n := m.PendingDeletions(); n != 1 {
+		t.Errorf("exactly one deletion should be pending, got %d", n)
+	}
+	// traversal via next() unlinks all marked nodes
+	m.ForEach(func(int, int) bool { return true })
+	if n := m.PendingDeletions(); n != 0 {
+		t.Errorf("pending deletions should be unlinked after traversal, got %d", n)
+	}
+}
+
+// Set must never lose an entry even when a resize is running concurrently
+func TestSetDuringGrow(t *testing.T) {
+	const (
+		writers       = 8
+		keysPerWriter = 2000
+		grows         = 12
+	)
+	for run := 0; run < 3; run++ {
+		m := New[int, int]()
+		var wg sync.WaitGroup
+		wg.Add(writers + 1)
+		go func() {
+			defer wg.Done()
+			for i := 0; i < grows; i++ {
+				m.Grow(0)
+			}
+		}()
+		for w := 0; w < writers; w++ {
+			go func(w int) {
+				defer wg.Done()
+				for i := w * keysPerWriter; i < (w+1)*keysPerWriter; i++ {
+					m.Set(i, i)
+					if _, ok := m.Get(i); !ok {
+						t.Errorf("key %d not visible right after Set", i)
+					}
+				}
+			}(w)
+		}
+		wg.Wait()
+		for i := 0; i < writers*keysPerWriter; i++ {
+			if v, ok := m.Get(i); !ok || v != i {
+				t.Fatalf("key %d missing after concurrent grow", i)
+			}
+		}
+	}
+}
+
+// regression test for inserts getting lost when the metadata is swapped mid-operation
+func TestInsertDuringRepeatedGrow(t *testing.T) {
+	const (
+		writers       = 6
+		keysPerWriter = 1500
+	)
+	inserters := []func(m *Map[int, int], key int){
+		func(m *Map[int, int], key int) { m.Set(key, key) },
+		func(m *Map[int, int], key int) { m.GetOrSet(key, key) },
+		func(m *Map[int, int], key int) { m.GetOrCompute(key, func() int { return key }) },
+	}
+	for _, insert := range inserters {
+		m := New[int, int]()
+		var (
+			wg   sync.WaitGroup
+			done = make(chan struct{})
+		)
+		wg.Add(writers + 1)
+		go func() {
+			defer wg.Done()
+			for i := 0; i < 12; i++ {
+				select {
+				case <-done:
+					return
+				default:
+					m.Grow(0)
+				}
+			}
+		}()
+		var writersWg sync.WaitGroup
+		writersWg.Add(writers)
+		for w := 0; w < writers; w++ {
+			go func(w int) {
+				defer wg.Done()
+				defer writersWg.Done()
+				for i := w * keysPerWriter; i < (w+1)*keysPerWriter; i++ {
+					insert(m, i)
+				}
+			}(w)
+		}
+		writersWg.Wait()
+		close(done)
+		wg.Wait()
+		if m.Len() != writers*keysPerWriter {
+			t.Errorf("map should contain %d items but has %d", writers*keysPerWriter, m.Len())
+		}
+		for i := 0; i < writers*keysPerWriter; i++ {
+			if v, ok := m.Get(i); !ok || v != i {
+				t.Fatalf("key %d missing after concurrent grow", i)
+			}
+		}
+	}
+}
+
+// an element must never be linked after a node which is concurrently being deleted
+// else it gets unlinked along with the deleted node and is lost
+func TestInsertNextToConcurrentDeletion(t *testing.T) {
+	const size = 1 << 12
+	for run := 0; run < 10; run++ {
+		m := New[int, int]()
+		m.SetHasher(func(key int) uintptr { return uintptr(key) << (strconv.IntSize - 13) }) // keep neighbouring keys adjacent in the list
+		for i := 2; i <= size; i += 2 {
+			m.Set(i, i)
+		}
+		var wg sync.WaitGroup
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			for i := 2; i <= size; i += 2 {
+				m.Del(i)
+			}
+		}()
+		go func() {
+			defer wg.Done()
+			for i := 1; i < size; i += 2 {
+				m.Set(i, i)
+			}
+		}()
+		wg.Wait()
+		for i := 1; i <= size; i++ {
+			_, ok := m.Get(i)
+			if i%2 == 0 && ok {
+				t.Fatalf("deleted key %d is still present", i)
+			} else if i%2 == 1 && !ok {
+				t.Fatalf("key %d inserted next to a deleted node was lost", i)
+			}
+		}
+		if m.Len() != size/2 {
+			t.Fatalf("map should contain %d items but has %d", size/2, m.Len())
+		}
+	}
+}
+
+// a node marked for deletion must reject any new successor
+func TestAddBeforeDeletedElement(t *testing.T) {
+	var (
+		head   = newListHead[int, int]()
+		first  = &element[int, int]{keyHash: 1, key: 1}
+		second = &element[int, int]{keyHash: 2, key: 2}
+	)
+	first.value.Store(new(valueBox[int]))
+	second.value.Store(new(valueBox[int]))
+	if !head.addBefore(first, nil) {
+		t.Fatal("element should have been linked to the list head")
+	}
+	if !first.remove() {
+		t.Fatal("element should have been marked for deletion")
+	}
+	if first.remove() {
+		t.Error("element should be marked for deletion exactly once")
+	}
+	if first.addBefore(second, nil) {
+		t.Error("element got linked after a deleted element")
+	}
+	if next := head.next(); next != nil {
+		t.Errorf("deleted element should have been unlinked, got key %d", next.key)
+	}
+}
+
+func TestClone(t *testing.T) {
+	m := New[int, *Animal]()
+	m.SetHasher(func(key int) uintptr { return uintptr(key) })
+	for i := 1; i <= 100; i++ {
+		m.Set(i, &Animal{strconv.Itoa(i)})
+	}
+	m.Del(50)
+
+	clone := m.Clone()
+	if clone.Len() != m.Len() {
+		t.Fatalf("clone should contain %d items but has %d", m.Len(), clone.Len())
+	}
+	if clone.hasher(7) != 7 {
+		t.Error("clone should use the same hasher as the source map")
+	}
+	m.ForEach(func(key int, value *Animal) bool {
+		if v, ok := clone.Get(key); !ok || v != value {
+			t.Errorf("clone has a wrong value for key %d", key)
+		}
+		return true
+	})
+	if _, ok := clone.Get(50); ok {
+		t.Error("deleted key should not be present in the clone")
+	}
+
+	clone.Set(101, &Animal{"101"})
+	clone.Del(1)
+	if _, ok := m.Get(101); ok {
+		t.Error("modifying the clone should not affect the source map")
+	}
+	if _, ok := m.Get(1); !ok {
+		t.Error("deleting from the clone should not affect the source map")
+	}
+}
+
+func TestEqual(t *testing.T) {
+	eq := func(a, b string) bool { return a == b }
+	m1, m2 := New[int, string](), New[int, string]()
+	if !m1.Equal(m2, eq) {
+		t.Error("empty maps should be equal")
+	}
+	for i := 0; i < 10; i++ {
+		m1.Set(i, strconv.Itoa(i))
+		m2.Set(9-i, strconv.Itoa(9-i))
+	}
+	if !m1.Equal(m2, eq) || !m2.Equal(m1, eq) {
+		t.Error("maps with the same pairs should be equal")
+	}
+	m2.Set(3, "three")
+	if m1.Equal(m2, eq) {
+		t.Error("maps with different values should not be equal")
+	}
+	m2.Set(3, "3")
+	m2.Del(4)
+	m2.Set(10, "4")
+	if m1.Equal(m2, eq) {
+		t.Error("maps with different keys should not be equal")
+	}
+	m2.Del(10)
+	if m1.Equal(m2, eq) {
+		t.Error("maps with different lengths should not be equal")
+	}
+
+	// expired entries are counted by Len() until removed but must not make the maps unequal
+	m2.Set(4, "4")
+	m2.SetWithTTL(100, "100", time.Nanosecond)
+	time.Sleep(time.Millisecond)
+	if !m1.Equal(m2, eq) || !m2.Equal(m1, eq) {
+		t.Error("maps differing only in expired entries should be equal")
+	}
+	if m2.expiring.Load() != 1 || m1.expiring.Load() != 0 {
+		t.Error("only the map holding entries with a TTL should be marked")
+	}
+}
+
+func TestGob(t *testing.T) {
+	type payload struct {
+		M *Map[float64, []string]
+	}
+	var (
+		buf bytes.Buffer
+		src = payload{M: New[float64, []string]()}
+		dst payload
+	)
+	for i := 0; i < 100; i++ {
+		src.M.Set(float64(i)+0.5, []string{strconv.Itoa(i)})
+	}
+	if err := gob.NewEncoder(&buf).Encode(src); err != nil {
+		t.Fatal(err)
+	}
+	if err := gob.NewDecoder(&buf).Decode(&dst); err != nil {
+		t.Fatal(err)
+	}
+	if dst.M.Len() != src.M.Len() {
+		t.Fatalf("decoded map should contain %d items but has %d", src.M.Len(), dst.M.Len())
+	}
+	src.M.ForEach(func(key float64, value []string) bool {
+		if v, ok := dst.M.Get(key); !ok || len(v) != 1 || v[0] != value[0] {
+			t.Errorf("decoded map has a wrong value for key %v", key)
+		}
+		return true
+	})
+
+	t.Run("empty map", func(t *testing.T) {
+		var buf bytes.Buffer
+		if err := gob.NewEncoder(&buf).Encode(New[string, int]()); err != nil {
+			t.Fatal(err)
+		}
+		m := New[string, int]()
+		if err := gob.NewDecoder(&buf).Decode(m); err != nil {
+			t.Fatal(err)
+		}
+		if m.Len() != 0 {
+			t.Errorf("decoded map should be empty but has %d items", m.Len())
+		}
+	})
+}
+
+func TestRange(t *testing.T) {
+	m := New[int, int]()
+	for i := 0; i < 10; i++ {
+		m.Set(i, i)
+	}
+	counter := 0
+	if err := m.Range(func(key, value int) error {
+		counter++
+		return nil
+	}); err != nil {
+		t.Errorf("unexpected error %v", err)
+	}
+	if counter != 10 {
+		t.Errorf("Range should have visited 10 items but visited %d", counter)
+	}
+
+	errStop := errors.New("stop")
+	counter = 0
+	if err := m.Range(func(key, value int) error {
+		if counter++; counter == 3 {
+			return errStop
+		}
+		return nil
+	}); err != errStop {
+		t.Errorf("Range should have returned the error from the lambda, got %v", err)
+	}
+	if counter != 3 {
+		t.Errorf("Range should have stopped at the first error but visited %d items", counter)
+	}
+}
+
+func TestPop(t *testing.T) {
+	m := New[int, int]()
+	if _, _, ok := m.Pop(); ok {
+		t.Error("Pop should fail on an empty map")
+	}
+
+	const (
+		items   = 1000
+		poppers = 8
+	)
+	for i := 0; i < items; i++ {
+		m.Set(i, i)
+	}
+	var (
+		wg     sync.WaitGroup
+		popped [items]int32
+	)
+	wg.Add(poppers)
+	for p := 0; p < poppers; p++ {
+		go func() {
+			defer wg.Done()
+			for {
+				key, value, ok := m.Pop()
+				if !ok {
+					return
+				}
+				if key != value {
+					t.Errorf("popped wrong value %d for key %d", value, key)
+				}
+				atomic.AddInt32(&popped[key], 1)
+			}
+		}()
+	}
+	wg.Wait()
+	for i := range popped {
+		if popped[i] != 1 {
+			t.Errorf("key %d should have been popped exactly once but was popped %d times", i, popped[i])
+		}
+	}
+	if m.Len() != 0 {
+		t.Errorf("map should be empty after popping all items but has %d items", m.Len())
+	}
+}
+
+func TestNewBounded(t *testing.T) {
+	var evicted int32
+	m := NewBounded[int, int](100, func(key, value int) {
+		if key != value {
+			t.Errorf("evicted wrong value %d for key %d", value, key)
+		}
+		atomic.AddInt32(&evicted, 1)
+	})
+	for i := 0; i < 100; i++ {
+		m.Set(i, i)
+	}
+	if evicted != 0 || m.Len() != 100 {
+		t.Fatalf("nothing should be evicted until the bound is reached, evicted %d items", evicted)
+	}
+	m.Set(0, 0) // updates do not evict
+	m.Set(100, 100)
+	if evicted != 1 || m.Len() != 100 {
+		t.Errorf("exactly one item should have been evicted, evicted %d items and has %d items", evicted, m.Len())
+	}
+	if _, ok := m.Get(100); !ok {
+		t.Error("newly inserted item should never be evicted")
+	}
+
+	t.Run("concurrent", func(t *testing.T) {
+		var wg sync.WaitGroup
+		for w := 0; w < 8; w++ {
+			wg.Add(1)
+			go func(w int) {
+				defer wg.Done()
+				for i := 0; i < 500; i++ {
+					key := 1000 + w*500 + i
+					m.Set(key, key)
+					m.GetOrSet(-key, -key)
+				}
+			}(w)
+		}
+		wg.Wait()
+		if m.Len() != 100 {
+			t.Errorf("bounded map should be full with 100 items but has %d items", m.Len())
+		}
+		if evicted != 1+8*500*2 {
+			t.Errorf("every overflowing insertion should evict exactly one item, evicted %d items", evicted)
+		}
+		if n := len(m.metadata.Load().index); n != 256 {
+			t.Errorf("bounded map should never be resized, new size: %d", n)
+		}
+	})
+
+	t.Run("boundary", func(t *testing.T) {
+		single := NewBounded[int, int](1, nil)
+		single.Set(1, 1)
+		single.Set(2, 2)
+		if _, ok := single.Get(2); !ok || single.Len() != 1 {
+			t.Errorf("map bounded to 1 item should only hold the newest item, has %d items", single.Len())
+		}
+
+		defer func() {
+			if recover() == nil {
+				t.Error("expected panic for a bound of 0 items")
+			}
+		}()
+		NewBounded[int, int](0, nil)
+	})
+}
+
+func TestTTL(t *testing.T) {
+	m := New[int, string]()
+	m.SetWithTTL(1, "one", 20*time.Millisecond)
+	m.SetWithTTL(2, "two", time.Hour)
+	m.SetWithTTL(3, "three", 20*time.Millisecond)
+	if v, ok := m.Get(1); !ok || v != "one" {
+		t.Error("entry should be present before its TTL elapses")
+	}
+	time.Sleep(30 * time.Millisecond)
+
+	if _, ok := m.Get(1); ok {
+		t.Error("expired entry should be absent")
+	}
+	if _, ok := m.Get(2); !ok {
+		t.Error("entry should be present before its TTL elapses")
+	}
+	if v, loaded := m.GetOrSet(3, "3"); loaded || v != "3" {
+		t.Error("expired entry should be replaced by GetOrSet")
+	}
+	if v, ok := m.Get(3); !ok || v != "3" {
+		t.Error("entry replaced by GetOrSet should not expire")
+	}
+
+	m.SetWithTTL(4, "four", 0)
+	time.Sleep(time.Millisecond)
+	if removed := m.RemoveExpired(); removed != 2 {
+		t.Errorf("RemoveExpired should have removed 2 entries but removed %d", removed)
+	}
+	if m.Len() != 2 {
+		t.Errorf("map should contain 2 items after removing expired entries but has %d", m.Len())
+	}
+
+	m.SetWithTTL(5, "five", 0)
+	m.Set(5, "5")
+	time.Sleep(time.Millisecond)
+	if _, ok := m.Get(5); !ok {
+		t.Error("Set should remove the expiry of an entry")
+	}
+}
+
+func TestTTLTraversals(t *testing.T) {
+	m := New[int, int]()
+	for i := 0; i < 10; i++ {
+		m.Set(i, i)
+	}
+	m.SetWithTTL(100, 100, time.Nanosecond)
+	m.SetWithTTL(200, 200, time.Hour)
+	time.Sleep(time.Millisecond)
+
+	m.ForEach(func(key, _ int) bool {
+		if key == 100 {
+			t.Error("ForEach should skip expired entries")
+		}
+		return true
+	})
+	if n := len(m.Snapshot()); n != 11 {
+		t.Errorf("Snapshot should contain 11 live entries, got %d", n)
+	}
+	if n := m.CountFunc(func(int, int) bool { return true }); n != 11 {
+		t.Errorf("CountFunc should count 11 live entries, got %d", n)
+	}
+	if data, _ := m.MarshalJSON(); strings.Contains(string(data), "100") {
+		t.Errorf("MarshalJSON should skip expired entries, got %s", data)
+	}
+
+	for name, copied := range map[string]*Map[int, int]{
+		"Clone":       m.Clone(),
+		"MergeShards": MergeShards(m.Split(3)),
+	} {
+		if _, ok := copied.Get(100); ok {
+			t.Errorf("%s should leave out expired entries", name)
+		}
+		if copied.Len() != 11 {
+			t.Errorf("%s should contain 11 entries, got %d", name, copied.Len())
+		}
+		if !m.Equal(copied, func(a, b int) bool { return a == b }) {
+			t.Errorf("%s should be equal to the map ignoring expired entries", name)
+		}
+		for item := copied.listHead.next(); item != nil; item = item.next() {
+			if expiry := item.value.Load().expiry; (item.key == 200) != (expiry != 0) {
+				t.Errorf("%s should keep the expiry of key %d, got %d", name, item.key, expiry)
+			}
+		}
+	}
+}
+
+func TestSetMaxFillRate(t *testing.T) {
+	m := New[int, int](16)
+	m.SetHasher(func(key int) uintptr { return uintptr(key) << (strconv.IntSize - 4) }) // one key per index slot
+	m.SetMaxFillRate(75)
+	for i := 0; i < 12; i++ {
+		m.Set(i, i)
+	}
+	if n := len(m.metadata.Load().index); n != 16 {
+		t.Fatalf("map should not be resized until 75%% fill, new size: %d", n)
+	}
+	m.Set(12, 12)
+	if n := len(m.metadata.Load().index); n != 32 {
+		t.Errorf("map should be resized beyond 75%% fill, size: %d", n)
+	}
+
+	m.SetMaxFillRate(100)
+	if rate := m.maxFillRate.Load(); rate != 90 {
+		t.Errorf("fill rate should be clamped to 90 but is %d", rate)
+	}
+	m.SetMaxFillRate(1)
+	if rate := m.maxFillRate.Load(); rate != 10 {
+		t.Errorf("fill rate should be clamped to 10 but is %d", rate)
+	}
+}
+
+func TestNewWithOptions(t *testing.T) {
+	hasher := func(key string) uintptr { return uintptr(len(key)) }
+	m := NewWithOptions(
+		WithInitialSize[string, int](100),
+		WithHasher[string, int](hasher),
+		WithMaxFillRate[string, int](75),
+	)
+	if n := len(m.metadata.Load().index); n != 128 {
+		t.Errorf("map index size should be 128 but is %d", n)
+	}
+	if m.hasher("four") != 4 {
+		t.Error("map should use the hasher provided in the options")
+	}
+	if rate := m.maxFillRate.Load(); rate != 75 {
+		t.Errorf("fill rate should be 75 but is %d", rate)
+	}
+	m.Set("one", 1)
+	if v, ok := m.Get("one"); !ok || v != 1 {
+		t.Error("item stored in the map should be retrievable")
+	}
+
+	m = NewWithOptions[string, int]()
+	if n := len(m.metadata.Load().index); n != defaultSize {
+		t.Errorf("map index size should be the default size but is %d", n)
+	}
+	if rate := m.maxFillRate.Load(); rate != defaultMaxFillRate {
+		t.Errorf("fill rate should be the default but is %d", rate)
+	}
+}
+
+func testDefaultHasher[K hashable](t *testing.T, keys ...K) {
+	t.Helper()
+	var (
+		hasher = DefaultHasher[K]()
+		m      = New[K, struct{}]()
+	)
+	if hasher == nil {
+		t.Fatalf("no default hasher for key type %T", *new(K))
+	}
+	for _, key := range keys {
+		if hasher(key) != m.hasher(key) {
+			t.Errorf("default hasher differs from the map hasher for key %v of type %T", key, key)
+		}
+	}
+}
+
+func TestDefaultHasher(t *testing.T) {
+	type customString string
+	testDefaultHasher[string](t, "", "a", "haxmap", "a string longer than thirty two bytes in length")
+	testDefaultHasher[customString](t, "", "custom")
+	testDefaultHasher[int](t, -1, 0, 1<<30)
+	testDefaultHasher[uint](t, 0, 1<<31)
+	testDefaultHasher[uintptr](t, 0, 42)
+	testDefaultHasher[int8](t, -8, 8)
+	testDefaultHasher[uint8](t, 0, 255)
+	testDefaultHasher[int16](t, -16, 16)
+	testDefaultHasher[uint16](t, 0, 1<<15)
+	testDefaultHasher[int32](t, -32, 32)
+	testDefaultHasher[uint32](t, 0, 1<<31)
+	testDefaultHasher[int64](t, -64, 64)
+	testDefaultHasher[uint64](t, 0, 1<<63)
+	testDefaultHasher[float32](t, 1.3, -0.5)
+	testDefaultHasher[float64](t, 1.3, -0.5)
+	testDefaultHasher[complex64](t, 1+2i, -3i)
+	testDefaultHasher[complex128](t, 1+2i, 1+3i)
+	testDefaultHasher[Key128](t, Key128{}, Key128{Hi: 1, Lo: 2})
+
+	salted := func(key string) uintptr { return DefaultHasher[string]()(key) ^ 0x5a5a }
+	m := NewWithOptions(WithHasher[string, int](salted))
+	m.Set("salt", 1)
+	if v, ok := m.Get("salt"); !ok || v != 1 {
+		t.Error("map with a composed default hasher should work")
+	}
+}
+
+func TestSetSeededHasher(t *testing.T) {
+	m1, m2 := New[string, int](1<<10), New[string, int](1<<10)
+	m1.SetSeededHasher(1)
+	m2.SetSeededHasher(2)
+
+	var (
+		keyshifts = m1.metadata.Load().keyshifts
+		differ    = 0
+	)
+	for i := 0; i < 100; i++ {
+		key := strconv.Itoa(i)
+		if m1.hasher(key)>>keyshifts != m2.hasher(key)>>keyshifts {
+			differ++
+		}
+		m1.Set(key, i)
+	}
+	if differ < 90 {
+		t.Errorf("differently seeded maps should place most keys in different slots, only %d of 100 differ", differ)
+	}
+	for i := 0; i < 100; i++ {
+		if v, ok := m1.Get(strconv.Itoa(i)); !ok || v != i {
+			t.Errorf("key %d missing from seeded map", i)
+		}
+	}
+
+	m3 := New[complex128, int]()
+	m3.SetSeededHasher(1)
+	m3.Set(1+2i, 1)
+	m3.Set(1+3i, 2)
+	if v, ok := m3.Get(1 + 3i); !ok || v != 2 || m3.Len() != 2 {
+		t.Error("seeded hasher should work for non string keys")
+	}
+
+	defer func() {
+		if recover() == nil {
+			t.Error("SetSeededHasher should panic on a non-empty map")
+		}
+	}()
+	m1.SetSeededHasher(3)
+}
+
+func TestLiveLen(t *testing.T) {
+	m := New[int, int]()
+	for i := 0; i < 100; i++ {
+		m.Set(i, i)
+	}
+	if m.Len() != 100 || m.LiveLen() != 100 {
+		t.Errorf("both counts should be 100, Len: %d, LiveLen: %d", m.Len(), m.LiveLen())
+	}
+	for i := 0; i < 100; i += 3 {
+		m.Del(i)
+	}
+	m.ForEach(func(int, int) bool { return true }) // compact the list
+	if m.PendingDeletions() != 0 {
+		t.Errorf("all deleted nodes should be unlinked, pending: %d", m.PendingDeletions())
+	}
+	if m.Len() != 66 || m.LiveLen() != m.Len() {
+		t.Errorf("both counts should be 66, Len: %d, LiveLen: %d", m.Len(), m.LiveLen())
+	}
+}
+
+func TestAdd(t *testing.T) {
+	m := New[string, int64]()
+	if v := Add(m, "counter", 5); v != 5 {
+		t.Errorf("Add should insert delta for an absent key, got %d", v)
+	}
+	if v := Add(m, "counter", -2); v != 3 {
+		t.Errorf("Add should return the new total, got %d", v)
+	}
+
+	const (
+		workers    = 8
+		increments = 1000
+	)
+	var wg sync.WaitGroup
+	wg.Add(workers)
+	for w := 0; w < workers; w++ {
+		go func() {
+			defer wg.Done()
+			for i := 0; i < increments; i++ {
+				Add(m, "concurrent", 1)
+			}
+		}()
+	}
+	wg.Wait()
+	if v, _ := m.Get("concurrent"); v != workers*increments {
+		t.Errorf("concurrent increments should total %d but got %d", workers*increments, v)
+	}
+
+	f := New[int, float64]()
+	Add(f, 1, 0.5)
+	if v := Add(f, 1, 0.25); v != 0.75 {
+		t.Errorf("Add should work for float values, got %v", v)
+	}
+}
+
+func TestForEachOrdered(t *testing.T) {
+	m := NewWithOptions(WithInsertionOrder[int, string]())
+	keys := []int{42, 7, 1000, -3, 15, 8, 99}
+	for _, key := range keys {
+		m.Set(key, strconv.Itoa(key))
+	}
+	m.Set(7, "seven") // updates keep their position
+	m.Del(1000)
+	m.GetAndDel(8)
+	m.Set(1000, "1000") // re-insertion moves to the end
+
+	var (
+		expected = []int{42, 7, -3, 15, 99, 1000}
+		got      []int
+	)
+	m.ForEachOrdered(func(key int, value string) bool {
+		got = append(got, key)
+		return true
+	})
+	if fmt.Sprint(got) != fmt.Sprint(expected) {
+		t.Errorf("expected insertion order %v but got %v", expected, got)
+	}
+
+	got = got[:0]
+	m.ForEachOrdered(func(key int, value string) bool {
+		got = append(got, key)
+		return len(got) < 2
+	})
+	if len(got) != 2 {
+		t.Errorf("iteration should stop when lambda returns false, visited %d items", len(got))
+	}
+
+	m.Clear()
+	m.Set(5, "5")
+	got = got[:0]
+	m.ForEachOrdered(func(key int, value string) bool {
+		got = append(got, key)
+		return true
+	})
+	if len(got) != 1 || got[0] != 5 {
+		t.Errorf("insertion order should be reset by Clear, got %v", got)
+	}
+
+	t.Run("concurrent", func(t *testing.T) {
+		m := NewWithOptions(WithInsertionOrder[int, int]())
+		var wg sync.WaitGroup
+		for w := 0; w < 4; w++ {
+			wg.Add(1)
+			go func(w int) {
+				defer wg.Done()
+				for i := w * 1000; i < (w+1)*1000; i++ {
+					m.Set(i, i)
+					if i%2 == 0 {
+						m.Del(i)
+					}
+				}
+			}(w)
+		}
+		wg.Wait()
+		counter := uintptr(0)
+		m.ForEachOrdered(func(key, value int) bool {
+			if key%2 == 0 {
+				t.Errorf("deleted key %d found in insertion order", key)
+			}
+			counter++
+			return true
+		})
+		if counter != m.Len() {
+			t.Errorf("insertion order should contain %d items but has %d", m.Len(), counter)
+		}
+	})
+}
+
+func TestForEachReverse(t *testing.T) {
+	m := New[int, int]()
+	for i := 0; i < 100; i++ {
+		m.Set(i, i)
+	}
+	m.Del(10, 20, 30)
+
+	var forward, reverse []int
+	m.ForEach(func(key, value int) bool {
+		forward = append(forward, key)
+		return true
+	})
+	m.ForEachReverse(func(key, value int) bool {
+		reverse = append(reverse, key)
+		return true
+	})
+	if len(reverse) != 97 || len(forward) != len(reverse) {
+		t.Fatalf("reverse iteration should visit 97 items but visited %d", len(reverse))
+	}
+	for i := range forward {
+		if forward[i] != reverse[len(reverse)-1-i] {
+			t.Fatal("reverse iteration should visit items in the opposite order of ForEach")
+		}
+	}
+
+	counter := 0
+	m.ForEachReverse(func(key, value int) bool {
+		counter++
+		return counter < 5
+	})
+	if counter != 5 {
+		t.Errorf("iteration should stop when lambda returns false, visited %d items", counter)
+	}
+}
+
+func TestGetOrSetRef(t *testing.T) {
+	m := New[string, Animal]()
+	ref, loaded := m.GetOrSetRef("pet", Animal{"cat"})
+	if loaded || ref.name != "cat" {
+		t.Error("value should have been stored")
+	}
+	ref.name = "tiger" // in-place mutation
+	if v, _ := m.Get("pet"); v.name != "tiger" {
+		t.Errorf("in-place mutation should be visible, got %s", v.name)
+	}
+	ref2, loaded := m.GetOrSetRef("pet", Animal{"dog"})
+	if !loaded || ref2 != ref {
+		t.Error("pointer to the existing value should have been returned")
+	}
+	m.Set("pet", Animal{"lion"})
+	if ref.name != "tiger" {
+		t.Error("pointer should refer to a detached copy after the next write")
+	}
+}
+
+func TestGetAll(t *testing.T) {
+	m := New[int, string]()
+	for i := 0; i < 100; i++ {
+		m.Set(i, strconv.Itoa(i))
+	}
+	m.Del(50)
+	if got := m.GetAll(); len(got) != 0 {
+		t.Errorf("no keys should return an empty map, got %v", got)
+	}
+	got := m.GetAll(99, 3, 50, 1000, 42, 3)
+	if len(got) != 3 || got[99] != "99" || got[3] != "3" || got[42] != "42" {
+		t.Errorf("unexpected result %v", got)
+	}
+
+	t.Run("collisions", func(t *testing.T) {
+		m := New[string, int]()
+		m.SetHasher(func(key string) uintptr { return uintptr(len(key)) })
+		for _, key := range []string{"a", "b", "c", "dd", "ee"} {
+			m.Set(key, len(key))
+		}
+		got := m.GetAll("c", "ee", "a", "zz", "b", "dd")
+		if len(got) != 5 {
+			t.Errorf("all colliding keys should be found, got %v", got)
+		}
+	})
+}
+
+func TestForEachKey(t *testing.T) {
+	m := New[int, *Animal]()
+	for i := 0; i < 10; i++ {
+		m.Set(i, &Animal{strconv.Itoa(i)})
+	}
+	m.Del(4)
+	seen := make(map[int]bool)
+	m.ForEachKey(func(key int) bool {
+		seen[key] = true
+		return true
+	})
+	if len(seen) != 9 || seen[4] {
+		t.Errorf("ForEachKey should visit all 9 live keys, visited %v", seen)
+	}
+	counter := 0
+	m.ForEachKey(func(int) bool {
+		counter++
+		return false
+	})
+	if counter != 1 {
+		t.Errorf("iteration should stop when lambda returns false, visited %d keys", counter)
+	}
+}
+
+func TestWaitResize(t *testing.T) {
+	m := New[int, int]()
+	m.WaitResize() // returns immediately when not resizing
+
+	if !m.resizing.CompareAndSwap(notResizing, resizingInProgress) {
+		t.Fatal("map should not be resizing")
+	}
+	var finished int32
+	go func() {
+		time.Sleep(10 * time.Millisecond)
+		atomic.StoreInt32(&finished, 1)
+		m.grow(1 << 10)
+	}()
+	m.WaitResize()
+	if atomic.LoadInt32(&finished) != 1 {
+		t.Error("WaitResize returned before the resize finished")
+	}
+	if n := len(m.metadata.Load().index); n != 1<<10 {
+		t.Errorf("map should have been resized to %d but has size %d", 1<<10, n)
+	}
+}
+
+func TestIndexElementFallback(t *testing.T) {
+	const size = 64
+	m := New[int, int](size)
+	m.SetHasher(func(key int) uintptr { return uintptr(key) << (strconv.IntSize - 7) }) // two keys per index slot
+	for i := 1; i < size; i++ {
+		m.Set(i, i)
+	}
+	for lowest := 1; lowest < size; lowest++ {
+		m.Del(lowest)
+		if _, ok := m.Get(lowest); ok {
+			t.Fatalf("deleted key %d should be absent", lowest)
+		}
+		for i := lowest + 1; i < size; i++ {
+			if v, ok := m.Get(i); !ok || v != i {
+				t.Fatalf("key %d should be present after deleting the lowest key %d", i, lowest)
+			}
+		}
+		if elem := m.metadata.Load().indexElement(0); elem != nil && elem.isDeleted() {
+			t.Fatal("indexElement should never return a deleted element")
+		}
+	}
+	if elem := m.metadata.Load().indexElement(0); elem != nil {
+		t.Error("indexElement of an empty map should be nil")
+	}
+}
+
+func TestUnmarshalJSONPreGrow(t *testing.T) {
+	src := make(map[int]int, 1000)
+	for i := 0; i < 1000; i++ {
+		src[i] = i
+	}
+	payload, err := json.Marshal(src)
+	if err != nil {
+		t.Fatal(err)
+	}
+	m := New[int, int]()
+	if err := m.UnmarshalJSON(payload); err != nil {
+		t.Fatal(err)
+	}
+	if n := len(m.metadata.Load().index); n != 2048 {
+		t.Errorf("map should have been pre-grown to 2048 but has size %d", n)
+	}
+	if m.Len() != 1000 {
+		t.Errorf("map should contain 1000 items but has %d", m.Len())
+	}
+}
+
+func unmarshalBenchmarkPayload(b *testing.B) []byte {
+	src := make(map[int]int, 1<<16)
+	for i := 0; i < 1<<16; i++ {
+		src[i] = i
+	}
+	payload, err := json.Marshal(src)
+	if err != nil {
+		b.Fatal(err)
+	}
+	return payload
+}
+
+func BenchmarkUnmarshalJSON(b *testing.B) {
+	payload := unmarshalBenchmarkPayload(b)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		m := New[int, int]()
+		if err := m.UnmarshalJSON(payload); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+// the behaviour of UnmarshalJSON before pre-growing, resizing repeatedly while inserting
+func BenchmarkUnmarshalJSONPerEntryGrow(b *testing.B) {
+	payload := unmarshalBenchmarkPayload(b)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		m := New[int, int]()
+		gomap := make(map[int]int)
+		if err := json.Unmarshal(payload, &gomap); err != nil {
+			b.Fatal(err)
+		}
+		for k, v := range gomap {
+			m.Set(k, v)
+		}
+	}
+}
+
+func TestWriteJSON(t *testing.T) {
+	var buf bytes.Buffer
+	if err := New[int, string]().WriteJSON(&buf); err != nil || buf.String() != "{}" {
+		t.Errorf("empty map should be written as {}, got %q with error %v", buf.String(), err)
+	}
+
+	m := New[int, []string]()
+	for i := -50; i < 50; i++ {
+		m.Set(i, []string{strconv.Itoa(i), "<html>"})
+	}
+	buf.Reset()
+	if err := m.WriteJSON(&buf); err != nil {
+		t.Fatal(err)
+	}
+	var decoded map[int][]string
+	if err := json.Unmarshal(buf.Bytes(), &decoded); err != nil {
+		t.Fatalf("written JSON is invalid: %v", err)
+	}
+	if len(decoded) != 100 {
+		t.Errorf("decoded JSON should contain 100 entries but has %d", len(decoded))
+	}
+	m.ForEach(func(key int, value []string) bool {
+		if v := decoded[key]; len(v) != 2 || v[0] != value[0] || v[1] != value[1] {
+			t.Errorf("wrong value %v for key %d", v, key)
+		}
+		return true
+	})
+
+	s := New[string, int]()
+	s.Set(`quoted "key"`, 1)
+	buf.Reset()
+	if err := s.WriteJSON(&buf); err != nil {
+		t.Fatal(err)
+	}
+	if expected, _ := s.MarshalJSON(); buf.String() != string(expected) {
+		t.Errorf("WriteJSON output %q should match MarshalJSON output %q", buf.String(), expected)
+	}
+
+	f := New[float64, int]()
+	f.Set(1.5, 1)
+	if err := f.WriteJSON(io.Discard); err == nil {
+		t.Error("float keys should not be supported")
+	}
+}
+
+func TestCompareVersionAndSwap(t *testing.T) {
+	m := New[string, []int]() // slices are not comparable, versions avoid any value comparison
+	if _, _, ok := m.GetWithVersion("k"); ok {
+		t.Error("ok should be false when item is missing from map")
+	}
+	m.Set("k", []int{1})
+	value, version, ok := m.GetWithVersion("k")
+	if !ok || len(value) != 1 {
+		t.Fatal("item stored within the map should be retrievable")
+	}
+	if !m.CompareVersionAndSwap("k", version, []int{1, 2}) {
+		t.Error("swap with the current version should succeed")
+	}
+	if m.CompareVersionAndSwap("k", version, []int{3}) {
+		t.Error("swap with a stale version should fail")
+	}
+	_, version, _ = m.GetWithVersion("k")
+	m.Set("k", []int{4})
+	if m.CompareVersionAndSwap("k", version, []int{5}) {
+		t.Error("swap should fail after an intermediate Set")
+	}
+	if m.CompareVersionAndSwap("absent", 0, nil) {
+		t.Error("swap of an absent key should fail")
+	}
+
+	t.Run("concurrent", func(t *testing.T) {
+		const (
+			workers    = 8
+			increments = 500
+		)
+		m := New[int, int]()
+		m.Set(1, 0)
+		var wg sync.WaitGroup
+		wg.Add(workers)
+		for w := 0; w < workers; w++ {
+			go func() {
+				defer wg.Done()
+				for i := 0; i < increments; {
+					value, version, _ := m.GetWithVersion(1)
+					if m.CompareVersionAndSwap(1, version, value+1) {
+						i++
+					}
+				}
+			}()
+		}
+		wg.Wait()
+		if v, _ := m.Get(1); v != workers*increments {
+			t.Errorf("optimistic increments should total %d but got %d", workers*increments, v)
+		}
+	})
+
+	t.Run("refresh", func(t *testing.T) {
+		m := New[int, int]()
+		m.SetWithTTL(1, 1, time.Hour)
+		_, version, _ := m.GetWithVersion(1)
+		m.GetAndRefresh(1, 2*time.Hour)
+		if _, v, _ := m.GetWithVersion(1); v != version {
+			t.Errorf("refreshing the expiry should keep version %d, got %d", version, v)
+		}
+		if !m.CompareVersionAndSwap(1, version, 2) {
+			t.Error("swap should succeed after refreshing the expiry")
+		}
+		if !m.CompareAndSwap(1, 2, 3) {
+			t.Error("swap should keep succeeding after a swap of the value")
+		}
+		if expiry := m.listHead.next().value.Load().expiry; expiry == 0 {
+			t.Error("swaps should keep the expiry")
+		}
+	})
+
+	t.Run("concurrent readers", func(t *testing.T) {
+		const reads = 20000
+		m := New[int, int]()
+		m.Set(1, 0)
+		_, base, _ := m.GetWithVersion(1)
+
+		var (
+			wg      sync.WaitGroup
+			stop    int32
+			written = make(chan struct{})
+		)
+		go func() {
+			defer close(written)
+			for i := 1; atomic.LoadInt32(&stop) == 0; i++ {
+				m.Set(1, i)
+			}
+		}()
+		for r := 0; r < 4; r++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				for i := 0; i < reads; i++ {
+					// every Set moves on by one version, so the version determines the value
+					if value, version, _ := m.GetWithVersion(1); version != base+uint64(value) {
+						t.Errorf("value %d paired with version %d", value, version)
+						return
+					}
+				}
+			}()
+		}
+		wg.Wait()
+		atomic.StoreInt32(&stop, 1)
+		<-written
+	})
+}
+
+type stringerValue int
+
+func (s stringerValue) String() string { return "#" + strconv.Itoa(int(s)) }
+
+func TestString(t *testing.T) {
+	m := New[uintptr, stringerValue]()
+	if s := m.String(); s != "map[]" {
+		t.Errorf("empty map should print as map[], got %s", s)
+	}
+	m.Set(7, 7)
+	if s := m.String(); s != "map[7:#7]" {
+		t.Errorf("unexpected dump %s", s)
+	}
+	for i := uintptr(0); i < 100; i++ {
+		m.Set(i, stringerValue(i))
+	}
+	s := m.String()
+	if !strings.HasSuffix(s, " ...]") || strings.Count(s, ":") != 32 {
+		t.Errorf("dump should be capped at 32 entries followed by an ellipsis, got %s", s)
+	}
+	if fmt.Sprint(m) != s {
+		t.Error("map should implement fmt.Stringer")
+	}
+}
+
+func TestGetOrComputeErr(t *testing.T) {
+	var (
+		m       = New[string, int]()
+		errDial = errors.New("dial failed")
+		calls   = 0
+	)
+	if _, loaded, err := m.GetOrComputeErr("conn", func() (int, error) {
+		calls++
+		return 0, errDial
+	}); loaded || err != errDial {
+		t.Errorf("constructor error should be returned, got %v", err)
+	}
+	if m.Len() != 0 || m.LiveLen() != 0 {
+		t.Error("nothing should be stored when the constructor fails")
+	}
+	if v, loaded, err := m.GetOrComputeErr("conn", func() (int, error) {
+		calls++
+		return 42, nil
+	}); loaded || err != nil || v != 42 {
+		t.Errorf("value should have been computed and stored, got %d %v %v", v, loaded, err)
+	}
+	if v, loaded, err := m.GetOrComputeErr("conn", func() (int, error) {
+		calls++
+		return 0, errDial
+	}); !loaded || err != nil || v != 42 {
+		t.Errorf("existing value should have been loaded, got %d %v %v", v, loaded, err)
+	}
+	if calls != 2 {
+		t.Errorf("constructor should only be called for absent keys, called %d times", calls)
+	}
+}
+
+func TestSetGrowthFactor(t *testing.T) {
+	m := New[int, int](8)
+	m.Grow(0)
+	if n := len(m.metadata.Load().index); n != 16 {
+		t.Errorf("map should double by default, new size: %d", n)
+	}
+	m.SetGrowthFactor(4)
+	m.Grow(0)
+	if n := len(m.metadata.Load().index); n != 64 {
+		t.Errorf("map should grow by a factor of 4, new size: %d", n)
+	}
+	m.SetGrowthFactor(2.5)
+	m.Grow(0)
+	if n := len(m.metadata.Load().index); n != 256 {
+		t.Errorf("grown size should be rounded up to the next power of 2, new size: %d", n)
+	}
+	m.SetGrowthFactor(0.5)
+	m.Grow(0)
+	if n := len(m.metadata.Load().index); n != 1024 {
+		t.Errorf("invalid growth factor should be ignored, new size: %d", n)
+	}
+	m.SetGrowthFactor(1.5)
+	m.Grow(0)
+	if n := len(m.metadata.Load().index); n != 4096 {
+		t.Errorf("growth factor below 2 should be ignored, new size: %d", n)
+	}
+}
+
+func TestReserve(t *testing.T) {
+	m := New[int, int]()
+	for i := 0; i < 100; i++ {
+		m.Set(i, i)
+	}
+	m.Reserve(1000)
+	size := len(m.metadata.Load().index)
+	if size != 4096 {
+		t.Errorf("map should have been grown to 4096 to hold 1100 items but has size %d", size)
+	}
+	for i := 0; i < 100; i++ {
+		if _, ok := m.Get(i); !ok {
+			t.Fatalf("existing key %d should be retained", i)
+		}
+	}
+	for i := 100; i < 1100; i++ {
+		m.Set(i, i)
+	}
+	if n := len(m.metadata.Load().index); n != size {
+		t.Errorf("no resize should happen while inserting the reserved items, new size: %d", n)
+	}
+	m.Reserve(10)
+	if n := len(m.metadata.Load().index); n != size {
+		t.Errorf("map should not be resized if the capacity suffices, new size: %d", n)
+	}
+}
+
+func TestAppendKeysValues(t *testing.T) {
+	m := New[int, int]()
+	for i := 0; i < 100; i++ {
+		m.Set(i, i*2)
+	}
+	m.Del(10, 20)
+
+	keys := m.AppendKeys([]int{-1})
+	values := m.AppendValues([]int{-1})
+	if len(keys) != 99 || len(values) != 99 {
+		t.Fatalf("expected 99 elements after appending, got %d keys and %d values", len(keys), len(values))
+	}
+	if keys[0] != -1 || values[0] != -1 {
+		t.Error("existing elements of dst should be retained")
+	}
+	sum := 0
+	for i := 1; i < len(keys); i++ {
+		if keys[i] == 10 || keys[i] == 20 {
+			t.Errorf("deleted key %d should be skipped", keys[i])
+		}
+		sum += values[i] - keys[i]*2
+	}
+	if sum != 0 {
+		t.Error("keys and values should be appended in the same order")
+	}
+
+	buf := make([]int, 0, 128)
+	if allocs := testing.AllocsPerRun(10, func() { buf = m.AppendKeys(buf[:0]) }); allocs != 0 {
+		t.Errorf("appending into a slice with enough capacity should not allocate, got %v allocs", allocs)
+	}
+}
+
+func TestKey128(t *testing.T) {
+	m := New[Key128, int]()
+	for i := uint64(0); i < 1000; i++ {
+		m.Set(Key128{Hi: i, Lo: ^i}, int(i))
+	}
+	for i := uint64(0); i < 1000; i++ {
+		if v, ok := m.Get(Key128{Hi: i, Lo: ^i}); !ok || v != int(i) {
+			t.Fatalf("key %d should be retrieved, got %d %t", i, v, ok)
+		}
+		if _, ok := m.Get(Key128{Hi: ^i, Lo: i}); ok {
+			t.Fatalf("key with swapped halves %d should not be found", i)
+		}
+	}
+
+	h := DefaultHasher[Key128]()
+	if h(Key128{Hi: 1, Lo: 2}) == h(Key128{Hi: 2, Lo: 1}) {
+		t.Error("hash should depend on the order of the halves")
+	}
+	seen := make(map[uintptr]Key128)
+	for i := uint64(0); i < 1<<12; i++ {
+		for _, key := range []Key128{{Hi: i}, {Lo: i}} {
+			if other, ok := seen[h(key)]; ok && other != key {
+				t.Fatalf("hash collision between %v and %v", key, other)
+			}
+			seen[h(key)] = key
+		}
+	}
+
+	// every key collides, lookups must fall back to comparing both halves
+	c := New[Key128, int]()
+	c.SetHasher(func(Key128) uintptr { return 1 })
+	c.Set(Key128{Hi: 1, Lo: 2}, 1)
+	c.Set(Key128{Hi: 2, Lo: 1}, 2)
+	c.Set(Key128{Hi: 1, Lo: 3}, 3)
+	for key, expected := range map[Key128]int{{Hi: 1, Lo: 2}: 1, {Hi: 2, Lo: 1}: 2, {Hi: 1, Lo: 3}: 3} {
+		if v, ok := c.Get(key); !ok || v != expected {
+			t.Errorf("colliding key %v should map to %d, got %d %t", key, expected, v, ok)
+		}
+	}
+	c.Del(Key128{Hi: 2, Lo: 1})
+	if _, ok := c.Get(Key128{Hi: 2, Lo: 1}); ok || c.Len() != 2 {
+		t.Error("only the deleted colliding key should be removed")
+	}
+}
+
+func TestSnapshot(t *testing.T) {
+	m := New[int, int]()
+	for i := 0; i < 1000; i++ {
+		m.Set(i, i)
+	}
+
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for i := 1000; i < 5000; i++ {
+			m.Set(i, i)
+		}
+	}()
+	for i := 0; i < 10; i++ {
+		seen := make(map[int]bool)
+		for _, p := range m.Snapshot() {
+			if seen[p.Key] {
+				t.Fatalf("key %d occurs twice in the snapshot", p.Key)
+			}
+			if p.Key != p.Value {
+				t.Fatalf("key %d has wrong value %d", p.Key, p.Value)
+			}
+			seen[p.Key] = true
+		}
+		for j := 0; j < 1000; j++ {
+			if !seen[j] {
+				t.Fatalf("key %d present before the snapshot is missing", j)
+			}
+		}
+	}
+	wg.Wait()
+
+	m.Del(0)
+	if s := m.Snapshot(); len(s) != 4999 {
+		t.Errorf("snapshot should contain 4999 pairs but has %d", len(s))
+	}
+}
+
+func TestOnResize(t *testing.T) {
+	type resize struct{ oldSize, newSize uintptr }
+	var (
+		m       = New[int, int](8)
+		resizes []resize
+	)
+	m.OnResize(func(oldSize, newSize uintptr) {
+		resizes = append(resizes, resize{oldSize, newSize})
+		// calling back into the map must not deadlock
+		m.Set(-1, int(newSize))
+		if _, ok := m.Get(-1); !ok {
+			t.Error("map should be usable from within the callback")
+		}
+	})
+	m.Grow(64)
+	if len(resizes) != 1 || resizes[0] != (resize{8, 64}) {
+		t.Fatalf("expected a single resize from 8 to 64, got %v", resizes)
+	}
+
+	for i := 0; i < 1000; i++ {
+		m.Set(i, i)
+	}
+	for i := 1; i < len(resizes); i++ {
+		if resizes[i].oldSize != resizes[i-1].newSize || resizes[i].newSize <= resizes[i].oldSize {
+			t.Fatalf("resizes should be reported in order, got %v", resizes)
+		}
+	}
+	if last := resizes[len(resizes)-1].newSize; last != uintptr(len(m.metadata.Load().index)) {
+		t.Errorf("last reported size %d differs from the index size %d", last, len(m.metadata.Load().index))
+	}
+
+	m.OnResize(nil)
+	n := len(resizes)
+	m.Grow(0)
+	if len(resizes) != n {
+		t.Error("unregistered callback should not be invoked")
+	}
+}
+
+func TestTrySet(t *testing.T) {
+	m := New[int, int]()
+	if !m.TrySet(1, 1) {
+		t.Fatal("uncontended TrySet should succeed")
+	}
+	if v, ok := m.Get(1); !ok || v != 1 {
+		t.Errorf("value should have been set, got %d %t", v, ok)
+	}
+
+	m.resizing.Store(resizingInProgress)
+	if m.TrySet(2, 2) {
+		t.Error("TrySet should fail while a resize is in progress")
+	}
+	m.resizing.Store(notResizing)
+	if _, ok := m.Get(2); ok || m.Len() != 1 {
+		t.Error("failed TrySet should not modify the map")
+	}
+
+	const goroutines, perGoroutine = 8, 1000
+	var wg sync.WaitGroup
+	for g := 0; g < goroutines; g++ {
+		wg.Add(1)
+		go func(g int) {
+			defer wg.Done()
+			for i := g * perGoroutine; i < (g+1)*perGoroutine; i++ {
+				for !m.TrySet(i, i) {
+					runtime.Gosched()
+				}
+			}
+		}(g)
+	}
+	wg.Wait()
+	if m.Len() != goroutines*perGoroutine {
+		t.Errorf("expected %d items, got %d", goroutines*perGoroutine, m.Len())
+	}
+	for i := 0; i < goroutines*perGoroutine; i++ {
+		if v, ok := m.Get(i); !ok || v != i {
+			t.Fatalf("key %d should be present with its value, got %d %t", i, v, ok)
+		}
+	}
+
+	t.Run("no resize", func(t *testing.T) {
+		m := New[int, int](8)
+		resizes, capacity := m.resizes.Load(), m.Capacity()
+		for i := 0; i < 100; i++ {
+			if !m.TrySet(i, i) {
+				t.Fatalf("uncontended TrySet of key %d should succeed", i)
+			}
+		}
+		if m.resizes.Load() != resizes || m.Capacity() != capacity || m.resizing.Load() != notResizing {
+			t.Errorf("TrySet should never resize the map, capacity went from %d to %d", capacity, m.Capacity())
+		}
+		if err := m.Validate(); err != nil {
+			t.Error(err)
+		}
+
+		m.Set(100, 100)
+		if m.Capacity() == capacity {
+			t.Error("the next Set should grow the map filled by TrySet")
+		}
+		for i := 0; i <= 100; i++ {
+			if v, ok := m.Get(i); !ok || v != i {
+				t.Fatalf("key %d should be present with its value, got %d %t", i, v, ok)
+			}
+		}
+	})
+
+	t.Run("lazy", func(t *testing.T) {
+		m := NewLazy[int, int]()
+		if !m.TrySet(1, 1) {
+			t.Fatal("TrySet should allocate the index of a lazy map")
+		}
+		if v, ok := m.Get(1); !ok || v != 1 {
+			t.Errorf("value should have been set, got %d %t", v, ok)
+		}
+	})
+}
+
+func TestGetOrSetSameKeyStress(t *testing.T) {
+	const goroutines = 500
+	ops := map[string]func(m *Map[int, int], key, value int) (int, bool){
+		"GetOrSet": func(m *Map[int, int], key, value int) (int, bool) { return m.GetOrSet(key, value) },
+		"GetOrSetRef": func(m *Map[int, int], key, value int) (int, bool) {
+			actual, loaded := m.GetOrSetRef(key, value)
+			return *actual, loaded
+		},
+		"GetOrCompute": func(m *Map[int, int], key, value int) (int, bool) {
+			return m.GetOrCompute(key, func() int { return value })
+		},
+		"GetOrComputeErr": func(m *Map[int, int], key, value int) (int, bool) {
+			actual, loaded, _ := m.GetOrComputeErr(key, func() (int, error) { return value, nil })
+			return actual, loaded
+		},
+	}
+	for name, op := range ops {
+		for run := 0; run < 10; run++ {
+			var (
+				m       = New[int, int]()
+				wg      sync.WaitGroup
+				start   = make(chan struct{})
+				stored  int32
+				actuals = make([]int, goroutines)
+			)
+			for g := 0; g < goroutines; g++ {
+				wg.Add(1)
+				go func(g int) {
+					defer wg.Done()
+					<-start
+					actual, loaded := op(m, 42, g)
+					if !loaded {
+						atomic.AddInt32(&stored, 1)
+					}
+					actuals[g] = actual
+				}(g)
+			}
+			close(start)
+			wg.Wait()
+
+			if m.Len() != 1 {
+				t.Fatalf("%s: expected exactly one item, got %d", name, m.Len())
+			}
+			if n := atomic.LoadInt32(&stored); n != 1 {
+				t.Fatalf("%s: expected exactly one goroutine to store its value, got %d", name, n)
+			}
+			v, _ := m.Get(42)
+			for g, actual := range actuals {
+				if actual != v {
+					t.Fatalf("%s: goroutine %d got %d but the map holds %d", name, g, actual, v)
+				}
+			}
+		}
+	}
+}
+
+func TestGetAndSet(t *testing.T) {
+	m := New[string, int]()
+	if previous, loaded := m.GetAndSet("a", 1); loaded || previous != 0 {
+		t.Errorf("absent key should be inserted, got %d %t", previous, loaded)
+	}
+	if previous, loaded := m.GetAndSet("a", 2); !loaded || previous != 1 {
+		t.Errorf("previous value 1 should be returned, got %d %t", previous, loaded)
+	}
+	if v, ok := m.Get("a"); !ok || v != 2 || m.Len() != 1 {
+		t.Errorf("value should have been replaced, got %d %t", v, ok)
+	}
+
+	m.SetWithTTL("b", 1, time.Millisecond)
+	time.Sleep(2 * time.Millisecond)
+	if previous, loaded := m.GetAndSet("b", 2); loaded || previous != 0 {
+		t.Errorf("expired key should be treated as absent, got %d %t", previous, loaded)
+	}
+	time.Sleep(2 * time.Millisecond)
+	if v, ok := m.Get("b"); !ok || v != 2 {
+		t.Errorf("value stored over an expired entry should not expire, got %d %t", v, ok)
+	}
+
+	// every stored value must be returned exactly once as a previous value or remain in the map
+	const goroutines, perGoroutine = 8, 1000
+	var (
+		c    = New[int, int]()
+		wg   sync.WaitGroup
+		seen = make([]int32, goroutines*perGoroutine+1)
+		ins  int32
+	)
+	for g := 0; g < goroutines; g++ {
+		wg.Add(1)
+		go func(g int) {
+			defer wg.Done()
+			for i := 1; i <= perGoroutine; i++ {
+				if previous, loaded := c.GetAndSet(0, g*perGoroutine+i); loaded {
+					atomic.AddInt32(&seen[previous], 1)
+				} else {
+					atomic.AddInt32(&ins, 1)
+				}
+			}
+		}(g)
+	}
+	wg.Wait()
+	last, _ := c.Get(0)
+	seen[last]++
+	for v := 1; v < len(seen); v++ {
+		if seen[v] != 1 {
+			t.Fatalf("value %d observed %d times", v, seen[v])
+		}
+	}
+	if ins != 1 || c.Len() != 1 {
+		t.Errorf("key should be inserted exactly once, got %d insertions and length %d", ins, c.Len())
+	}
+}
+
+func TestSetAutoGrow(t *testing.T) {
+	m := New[int, int](64)
+	m.SetAutoGrow(false)
+	for i := 0; i < 1000; i++ {
+		m.Set(i, i)
+		m.GetOrSet(-i-1, i)
+		m.GetOrCompute(i+1000, func() int { return i })
+	}
+	if size := len(m.metadata.Load().index); size != 64 {
+		t.Fatalf("index size should stay pinned at 64 with auto-grow disabled, got %d", size)
+	}
+	for i := 0; i < 1000; i++ {
+		if v, ok := m.Get(i); !ok || v != i {
+			t.Fatalf("key %d should be retrievable beyond the fill rate, got %d %t", i, v, ok)
+		}
+	}
+
+	m.Grow(128)
+	if size := len(m.metadata.Load().index); size != 128 {
+		t.Errorf("explicit grow should resize to exactly 128 with auto-grow disabled, got %d", size)
+	}
+
+	m.SetAutoGrow(true)
+	m.Grow(256)
+	if size := len(m.metadata.Load().index); size != 8192 {
+		t.Errorf("map should keep growing until under the fill rate once auto-grow is enabled, got %d", size)
+	}
+}
+
+func TestBucketSizes(t *testing.T) {
+	m := New[int, int](8)
+	// slot i covers the hashes [i << (IntSize-3), (i+1) << (IntSize-3))
+	m.SetHasher(func(key int) uintptr { return uintptr(key) << (strconv.IntSize - 4) })
+	for i := 1; i <= 5; i++ {
+		m.Set(i, i)
+	}
+	m.Del(5)
+	expected := []int{1, 2, 1, 0, 0, 0, 0, 0}
+	if sizes := m.BucketSizes(); !reflect.DeepEqual(sizes, expected) {
+		t.Errorf("expected bucket sizes %v, got %v", expected, sizes)
+	}
+
+	d := New[int, int]()
+	for i := 0; i < 1000; i++ {
+		d.Set(i, i)
+	}
+	sizes, total := d.BucketSizes(), 0
+	for _, size := range sizes {
+		total += size
+	}
+	if len(sizes) != len(d.metadata.Load().index) || total != 1000 {
+		t.Errorf("bucket sizes should cover the index and sum up to 1000, got %d slots summing up to %d", len(sizes), total)
+	}
+}
+
+func TestComplexKeys(t *testing.T) {
+	// there is a single hash implementation for all platforms, only its result is truncated to the width of uintptr
+	h128, s128 := DefaultHasher[complex128](), seededHasher[complex128](1)
+	m128 := New[complex128, int]()
+	for i := 0; i < 100; i++ {
+		a, b := complex(1.5, float64(i)), complex(1.5, float64(i)+0.5)
+		if h128(a) == h128(b) || s128(a) == s128(b) {
+			t.Fatalf("complex128 keys %v and %v differing only in the imaginary part have the same hash", a, b)
+		}
+		if c := complex(float64(i)+0.5, 1.5); h128(c) == h128(complex(float64(i), 1.5)) {
+			t.Fatalf("complex128 keys differing only in the real part have the same hash")
+		}
+		m128.Set(a, 2*i)
+		m128.Set(b, 2*i+1)
+	}
+	for i := 0; i < 100; i++ {
+		if v, ok := m128.Get(complex(1.5, float64(i))); !ok || v != 2*i {
+			t.Fatalf("complex128 key %d should be retrievable, got %d %t", i, v, ok)
+		}
+		if v, ok := m128.Get(complex(1.5, float64(i)+0.5)); !ok || v != 2*i+1 {
+			t.Fatalf("complex128 key %d.5 should be retrievable, got %d %t", i, v, ok)
+		}
+	}
+
+	h64 := DefaultHasher[complex64]()
+	m64 := New[complex64, int]()
+	for i := 0; i < 100; i++ {
+		a, b := complex(float32(1.5), float32(i)), complex(float32(1.5), float32(i)+0.5)
+		if h64(a) == h64(b) {
+			t.Fatalf("complex64 keys %v and %v differing only in the imaginary part have the same hash", a, b)
+		}
+		m64.Set(a, 2*i)
+		m64.Set(b, 2*i+1)
+	}
+	if m64.Len() != 200 {
+		t.Errorf("all complex64 keys should be stored, got %d", m64.Len())
+	}
+}
+
+func TestDrain(t *testing.T) {
+	m := NewWithOptions(WithInsertionOrder[int, int]())
+	for i := 0; i < 1000; i++ {
+		m.Set(i, i*2)
+	}
+	m.Del(0)
+
+	drained := m.Drain()
+	if len(drained) != 999 {
+		t.Fatalf("expected 999 drained pairs, got %d", len(drained))
+	}
+	for i := 1; i < 1000; i++ {
+		if v, ok := drained[i]; !ok || v != i*2 {
+			t.Fatalf("key %d should be drained with its value, got %d %t", i, v, ok)
+		}
+	}
+	if m.Len() != 0 || m.LiveLen() != 0 {
+		t.Errorf("map should be empty after draining, got length %d", m.Len())
+	}
+	if _, ok := m.Get(1); ok {
+		t.Error("drained key should be absent")
+	}
+	m.ForEachOrdered(func(int, int) bool {
+		t.Error("insertion order should be reset after draining")
+		return false
+	})
+
+	m.Set(1, 1)
+	if v, ok := m.Get(1); !ok || v != 1 || m.Len() != 1 {
+		t.Error("map should be usable after draining")
+	}
+	if len(New[int, int]().Drain()) != 0 {
+		t.Error("draining an empty map should return an empty map")
+	}
+
+	// concurrent readers must not observe a partially drained map
+	c := New[int, int]()
+	for i := 0; i < 1000; i++ {
+		c.Set(i, i)
+	}
+	var wg sync.WaitGroup
+	stop := make(chan struct{})
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for {
+			select {
+			case <-stop:
+				return
+			default:
+			}
+			if v, ok := c.Get(500); ok && v != 500 {
+				t.Errorf("wrong value %d", v)
+			}
+		}
+	}()
+	if len(c.Drain()) != 1000 {
+		t.Error("all pairs should be drained")
+	}
+	close(stop)
+	wg.Wait()
+
+	t.Run("concurrent writers", func(t *testing.T) {
+		const (
+			writers   = 4
+			perWriter = 20000
+		)
+		m := NewWithOptions(WithInsertionOrder[int, int]())
+		var (
+			wg      sync.WaitGroup
+			drained = make(map[int]int)
+			done    = make(chan struct{})
+		)
+		for w := 0; w < writers; w++ {
+			wg.Add(1)
+			go func(w int) {
+				defer wg.Done()
+				for i := w * perWriter; i < (w+1)*perWriter; i++ {
+					m.Set(i, i)
+				}
+			}(w)
+		}
+		go func() {
+			wg.Wait()
+			close(done)
+		}()
+		for running := true; running; {
+			select {
+			case <-done:
+				running = false
+			default:
+			}
+			for key, value := range m.Drain() {
+				if _, ok := drained[key]; ok || value != key {
+					t.Fatalf("key %d drained twice or with wrong value %d", key, value)
+				}
+				drained[key] = value
+			}
+		}
+
+		if err := m.Validate(); err != nil {
+			t.Fatal(err)
+		}
+		m.ForEach(func(key, _ int) bool {
+			if _, ok := drained[key]; ok {
+				t.Fatalf("drained key %d still present", key)
+			}
+			drained[key] = key
+			return true
+		})
+		if len(drained) != writers*perWriter {
+			t.Errorf("every key should either be drained or remain in the map, lost %d keys", writers*perWriter-len(drained))
+		}
+	})
+
+	t.Run("store into a drained element", func(t *testing.T) {
+		m := New[int, int]()
+		m.Set(1, 1)
+		elem := m.listHead.next()
+		m.Drain()
+		// a writer which found the element before it got drained must retry instead of reporting its store as done
+		value := 2
+		if alloc, _, stored := elem.inject(elem.keyHash, 1, &value, 0, true); alloc != nil || stored {
+			t.Error("store into a drained element should be retried")
+		}
+	})
+
+	t.Run("concurrent updates", func(t *testing.T) {
+		const (
+			writers = 4
+			keys    = 64
+			rounds  = 2000
+		)
+		m := New[int, int]()
+		var (
+			wg      sync.WaitGroup
+			drained = make(map[int]int)
+			done    = make(chan struct{})
+		)
+		for w := 0; w < writers; w++ {
+			wg.Add(1)
+			go func(w int) {
+				defer wg.Done()
+				for r := 0; r < rounds; r++ {
+					for k := w * keys; k < (w+1)*keys; k++ {
+						m.Set(k, r)
+					}
+				}
+			}(w)
+		}
+		go func() {
+			wg.Wait()
+			close(done)
+		}()
+		for running := true; running; {
+			select {
+			case <-done:
+				running = false
+			default:
+			}
+			for key, value := range m.Drain() {
+				drained[key] = value
+			}
+		}
+
+		// the last write of every key either got drained or remains in the map
+		for k := 0; k < writers*keys; k++ {
+			if v, ok := m.Get(k); !(ok && v == rounds-1) && drained[k] != rounds-1 {
+				t.Fatalf("last write of key %d got lost, map holds %d %t and %d was drained", k, v, ok, drained[k])
+			}
+		}
+	})
+}
+
+func TestForEachBatch(t *testing.T) {
+	m := New[int, int]()
+	for i := 0; i < 1000; i++ {
+		m.Set(i, i)
+	}
+
+	var batches, sum int
+	m.ForEachBatch(64, func(keys, values []int) bool {
+		if len(keys) != len(values) || len(keys) > 64 || len(keys) == 0 {
+			t.Fatalf("invalid batch with %d keys and %d values", len(keys), len(values))
+		}
+		for i := range keys {
+			if keys[i] != values[i] {
+				t.Fatalf("key %d has wrong value %d", keys[i], values[i])
+			}
+			sum += values[i]
+		}
+		batches++
+		return true
+	})
+	if batches != 16 || sum != 999*1000/2 {
+		t.Errorf("expected 16 batches summing up to %d, got %d batches summing up to %d", 999*1000/2, batches, sum)
+	}
+
+	batches = 0
+	m.ForEachBatch(100, func(keys, values []int) bool {
+		batches++
+		return false
+	})
+	if batches != 1 {
+		t.Errorf("iteration should stop after the first batch, got %d batches", batches)
+	}
+
+	m.ForEachBatch(0, func([]int, []int) bool {
+		t.Error("lambda should not be called for a non-positive batch size")
+		return false
+	})
+
+	// the pooled buffers must not retain the pairs once the iteration is done
+	p := New[int, *int]()
+	for i := 0; i < 10; i++ {
+		p.Set(i, new(int))
+	}
+	var retained []*int
+	p.ForEachBatch(8, func(_ []int, values []*int) bool {
+		retained = values[:cap(values)]
+		return true
+	})
+	for i, v := range retained {
+		if v != nil {
+			t.Errorf("pooled batch still holds a value at %d", i)
+		}
+	}
+}
+
+func BenchmarkForEachBatch(b *testing.B) {
+	m := New[int, int]()
+	for i := 0; i < 1<<16; i++ {
+		m.Set(i, i)
+	}
+	b.Run("ForEach", func(b *testing.B) {
+		for n := 0; n < b.N; n++ {
+			sum := 0
+			m.ForEach(func(_ int, v int) bool {
+				sum += v
+				return true
+			})
+		}
+	})
+	b.Run("ForEachBatch", func(b *testing.B) {
+		b.ReportAllocs()
+		for n := 0; n < b.N; n++ {
+			sum := 0
+			m.ForEachBatch(256, func(_ []int, values []int) bool {
+				for _, v := range values {
+					sum += v
+				}
+				return true
+			})
+		}
+	})
+}
+
+func TestHashSet(t *testing.T) {
+	a, b := NewHashSet[int](), NewHashSet[int]()
+	for i := 0; i < 10; i++ {
+		a.Add(i)
+		b.Add(i + 5)
+	}
+	a.Add(0)
+	if a.Len() != 10 || !a.Has(0) || a.Has(10) {
+		t.Fatal("set should contain the keys 0 to 9 exactly once")
+	}
+
+	keys := func(s *HashSet[int]) []int {
+		var keys []int
+		s.ForEach(func(key int) bool {
+			keys = append(keys, key)
+			return true
+		})
+		sort.Ints(keys)
+		return keys
+	}
+	cases := []struct {
+		name     string
+		set      *HashSet[int]
+		expected []int
+	}{
+		{"union", a.Union(b), []int{0, 1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11, 12, 13, 14}},
+		{"intersection", a.Intersect(b), []int{5, 6, 7, 8, 9}},
+		{"difference", a.Difference(b), []int{0, 1, 2, 3, 4}},
+		{"reverse difference", b.Difference(a), []int{10, 11, 12, 13, 14}},
+		{"empty intersection", a.Intersect(NewHashSet[int]()), nil},
+	}
+	for _, c := range cases {
+		if got := keys(c.set); !reflect.DeepEqual(got, c.expected) || c.set.Len() != uintptr(len(c.expected)) {
+			t.Errorf("%s: expected %v, got %v", c.name, c.expected, got)
+		}
+	}
+	if a.Len() != 10 || b.Len() != 10 {
+		t.Error("set algebra should not modify the operands")
+	}
+
+	a.Remove(0)
+	a.Remove(100)
+	if a.Has(0) || a.Len() != 9 {
+		t.Error("removed key should be absent")
+	}
+}
+
+func BenchmarkGetOrSetHit(b *testing.B) {
+	m := New[int, int]()
+	m.Set(1, 1)
+	b.Run("GetOrSet", func(b *testing.B) {
+		b.ReportAllocs()
+		for n := 0; n < b.N; n++ {
+			m.GetOrSet(1, n)
+		}
+	})
+	b.Run("GetOrCompute", func(b *testing.B) {
+		b.ReportAllocs()
+		for n := 0; n < b.N; n++ {
+			m.GetOrCompute(1, func() int { return n })
+		}
+	})
+}
+
+func TestGetOrSetHitAllocs(t *testing.T) {
+	m := New[int, int]()
+	m.Set(1, 1)
+	if allocs := testing.AllocsPerRun(100, func() { m.GetOrSet(1, 2) }); allocs != 0 {
+		t.Errorf("GetOrSet of an existing key should not allocate, got %v allocs", allocs)
+	}
+	if allocs := testing.AllocsPerRun(100, func() { m.GetOrSetRef(1, 2) }); allocs != 0 {
+		t.Errorf("GetOrSetRef of an existing key should not allocate, got %v allocs", allocs)
+	}
+	if v, _ := m.Get(1); v != 1 {
+		t.Error("existing value should not be replaced")
+	}
+}
+
+func TestNamedKeyTypes(t *testing.T) {
+	type (
+		customInt     int
+		customUint8   uint8
+		customUint32  uint32
+		customFloat64 float64
+	)
+	testDefaultHasher[customInt](t, -1, 0, 1<<30)
+	testDefaultHasher[customUint8](t, 0, 255)
+	testDefaultHasher[customUint32](t, 0, 1<<31)
+	testDefaultHasher[customFloat64](t, 1.3, -0.5)
+
+	m := New[customInt, int]()
+	for i := customInt(0); i < 100; i++ {
+		m.Set(i, int(i))
+	}
+	for i := customInt(0); i < 100; i++ {
+		if v, ok := m.Get(i); !ok || v != int(i) {
+			t.Fatalf("named integer key %d should be retrievable, got %d %t", i, v, ok)
+		}
+	}
+	if DefaultHasher[customInt]()(42) != DefaultHasher[int]()(42) {
+		t.Error("named type should hash like its underlying type")
+	}
+}
+
+func TestRequireHasher(t *testing.T) {
+	m := New[Key128, int]()
+	m.requireHasher() // must not panic for supported key types
+
+	m.storeHasher(nil)
+	defer func() {
+		r := recover()
+		msg, ok := r.(string)
+		if !ok || !strings.Contains(msg, "haxmap.Key128") || !strings.Contains(msg, "WithHasher") {
+			t.Errorf("expected a panic naming the key type, got %v", r)
+		}
+	}()
+	m.requireHasher()
+}
+
+func TestGetOrComputeSingleFlight(t *testing.T) {
+	const goroutines = 100
+	var (
+		m     = New[string, int]()
+		calls int32
+		wg    sync.WaitGroup
+		start = make(chan struct{})
+	)
+	for g := 0; g < goroutines; g++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			<-start
+			actual, _ := m.GetOrComputeSingleFlight("key", func() int {
+				time.Sleep(10 * time.Millisecond)
+				return int(atomic.AddInt32(&calls, 1))
+			})
+			if actual != 1 {
+				t.Errorf("all callers should receive the single computed value, got %d", actual)
+			}
+		}()
+	}
+	close(start)
+	wg.Wait()
+	if calls != 1 {
+		t.Errorf("value should be computed exactly once, got %d calls", calls)
+	}
+	if len(m.flights) != 0 {
+		t.Errorf("in-flight entries should be cleaned up, got %d", len(m.flights))
+	}
+	if actual, loaded := m.GetOrComputeSingleFlight("key", func() int { return 2 }); !loaded || actual != 1 {
+		t.Errorf("existing value should be loaded, got %d %t", actual, loaded)
+	}
+
+	// waiters recompute if the constructor of the flight they joined panics
+	entered, release := make(chan struct{}), make(chan struct{})
+	go func() {
+		defer func() { recover() }()
+		m.GetOrComputeSingleFlight("panic", func() int {
+			close(entered)
+			<-release
+			panic("constructor failed")
+		})
+	}()
+	<-entered
+	result := make(chan int)
+	go func() {
+		actual, _ := m.GetOrComputeSingleFlight("panic", func() int { return 3 })
+		result <- actual
+	}()
+	time.Sleep(5 * time.Millisecond)
+	close(release)
+	if actual := <-result; actual != 3 {
+		t.Errorf("waiter should compute the value itself after a panic, got %d", actual)
+	}
+	if len(m.flights) != 0 {
+		t.Errorf("in-flight entries should be cleaned up after a panic, got %d", len(m.flights))
+	}
+}
+
+func TestMinMax(t *testing.T) {
+	m := New[int, string]()
+	if _, _, ok := m.Min(); ok {
+		t.Error("Min of an empty map should not be ok")
+	}
+	if _, _, ok := m.Max(); ok {
+		t.Error("Max of an empty map should not be ok")
+	}
+
+	m.SetHasher(func(key int) uintptr { return uintptr(key) })
+	for i := 1; i <= 100; i++ {
+		m.Set(i, strconv.Itoa(i))
+	}
+	if k, v, ok := m.Min(); !ok || k != 1 || v != "1" {
+		t.Errorf("expected minimum 1, got %d %q %t", k, v, ok)
+	}
+	if k, v, ok := m.Max(); !ok || k != 100 || v != "100" {
+		t.Errorf("expected maximum 100, got %d %q %t", k, v, ok)
+	}
+
+	m.Del(1, 100)
+	if k, _, ok := m.Min(); !ok || k != 2 {
+		t.Errorf("deleted minimum should be skipped, got %d %t", k, ok)
+	}
+	if k, _, ok := m.Max(); !ok || k != 99 {
+		t.Errorf("deleted maximum should be skipped, got %d %t", k, ok)
+	}
+}
+
+func TestGetOrDefault(t *testing.T) {
+	m := New[string, int]()
+	m.Set("a", 1)
+	m.Set("b", 2)
+	m.Del("b")
+	m.SetWithTTL("c", 3, time.Millisecond)
+	time.Sleep(2 * time.Millisecond)
+
+	for key, expected := range map[string]int{"a": 1, "b": -1, "c": -1, "d": -1} {
+		if v := m.GetOrDefault(key, -1); v != expected {
+			t.Errorf("expected %d for key %q, got %d", expected, key, v)
+		}
+	}
+	if _, ok := m.Get("d"); ok {
+		t.Error("default value should not be stored")
+	}
+}
+
+func TestMetrics(t *testing.T) {
+	m := New[int, int](8)
+	// keys 1 to 3 share the first index slot
+	m.SetHasher(func(key int) uintptr { return uintptr(key) })
+	for i := 1; i <= 3; i++ {
+		m.Set(i, i)
+	}
+	m.Get(1)
+	if hits, misses, collisions := m.Metrics(); hits != 0 || misses != 0 || collisions != 0 {
+		t.Errorf("metrics should be zero before enabling, got %d %d %d", hits, misses, collisions)
+	}
+
+	m.EnableMetrics()
+	m.Get(1)
+	m.Get(3)
+	m.Get(4)
+	if v, ok := m.Get(3); !ok || v != 3 {
+		t.Errorf("instrumented Get should return the value, got %d %t", v, ok)
+	}
+	hits, misses, collisions := m.Metrics()
+	if hits != 3 || misses != 1 {
+		t.Errorf("expected 3 hits and 1 miss, got %d and %d", hits, misses)
+	}
+	if collisions != 0 {
+		t.Errorf("lookups should not count collisions, got %d", collisions)
+	}
+
+	// inserting 4 and updating 3 walk past other keys of the first slot, key 1 is its first element
+	// and the key 7 << (strconv.IntSize - 4) is the only one in its slot
+	m.Set(4, 4)
+	m.Set(1, 1)
+	m.Set(7<<(strconv.IntSize-4), 0)
+	m.Set(3, 3)
+	if _, _, collisions := m.Metrics(); collisions != 2 {
+		t.Errorf("expected 2 colliding insertions, got %d", collisions)
+	}
+	m.Del(2)
+	if _, ok := m.Get(2); ok {
+		t.Error("deleted key should be absent")
+	}
+	if _, misses, _ := m.Metrics(); misses != 2 {
+		t.Errorf("lookup of a deleted key should count as a miss, got %d misses", misses)
+	}
+
+	m.EnableMetrics()
+	if hits, misses, collisions := m.Metrics(); hits != 0 || misses != 0 || collisions != 0 {
+		t.Errorf("metrics should be reset by enabling them again, got %d %d %d", hits, misses, collisions)
+	}
+}
+
+func TestConcurrentDoubleDelete(t *testing.T) {
+	const keys, goroutines = 1000, 8
+	for run := 0; run < 10; run++ {
+		m := New[int, int]()
+		for i := 0; i < keys; i++ {
+			m.Set(i, i)
+		}
+		var (
+			wg    sync.WaitGroup
+			start = make(chan struct{})
+		)
+		for g := 0; g < goroutines; g++ {
+			wg.Add(1)
+			go func(g int) {
+				defer wg.Done()
+				<-start
+				for i := 0; i < keys; i++ {
+					switch g % 3 {
+					case 0:
+						m.Del(i)
+					case 1:
+						m.GetAndDel(i)
+					default:
+						m.Del(i, i+1)
+					}
+				}
+			}(g)
+		}
+		close(start)
+		wg.Wait()
+		if l := m.Len(); l != 0 {
+			t.Fatalf("length should be 0 after deleting every key concurrently, got %d", l)
+		}
+	}
+}
+
+func TestSetAndReport(t *testing.T) {
+	m := New[string, int]()
+	if m.SetAndReport("a", 1) {
+		t.Error("inserting an absent key should not report an overwrite")
+	}
+	if !m.SetAndReport("a", 2) {
+		t.Error("setting a present key should report an overwrite")
+	}
+	if v, ok := m.Get("a"); !ok || v != 2 || m.Len() != 1 {
+		t.Errorf("value should have been overwritten, got %d %t", v, ok)
+	}
+	m.Del("a")
+	if m.SetAndReport("a", 3) {
+		t.Error("inserting a deleted key should not report an overwrite")
+	}
+
+	var (
+		c           = New[int, int]()
+		wg          sync.WaitGroup
+		insertions  int32
+		goroutines  = 8
+		keysPerTest = 1000
+	)
+	for g := 0; g < goroutines; g++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := 0; i < keysPerTest; i++ {
+				if !c.SetAndReport(i, i) {
+					atomic.AddInt32(&insertions, 1)
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	if insertions != int32(keysPerTest) {
+		t.Errorf("every key should be reported as inserted exactly once, got %d insertions", insertions)
+	}
+}
+
+func TestForEachIndexed(t *testing.T) {
+	m := New[int, int]()
+	for i := 0; i < 10; i++ {
+		m.Set(i, i)
+	}
+	m.Del(3)
+
+	positions := 0
+	m.ForEachIndexed(func(i, k, v int) bool {
+		if i != positions {
+			t.Errorf("expected position %d for key %d, got %d", positions, k, i)
+		}
+		positions++
+		return true
+	})
+	if positions != 9 {
+		t.Errorf("only the 9 live pairs should be counted, got %d", positions)
+	}
+
+	last := -1
+	m.ForEachIndexed(func(i, _, _ int) bool {
+		last = i
+		return i < 4
+	})
+	if last != 4 {
+		t.Errorf("iteration should stop at position 4, got %d", last)
+	}
+}
+
+func TestDescribeMetrics(t *testing.T) {
+	m := New[int, int](8)
+	m.EnableMetrics()
+	for i := 0; i < 100; i++ {
+		m.Set(i, i)
+	}
+	m.Get(1)
+	m.Get(-1)
+
+	metrics := m.DescribeMetrics()
+	expected := map[string]float64{
+		"len":      100,
+		"capacity": float64(len(m.metadata.Load().index)),
+		"hits":     1,
+		"misses":   1,
+	}
+	for name, value := range expected {
+		if metrics[name] != value {
+			t.Errorf("expected %s to be %v, got %v", name, value, metrics[name])
+		}
+	}
+	if metrics["fill_rate"] != m.FillRateFloat() {
+		t.Errorf("fill rate should match FillRateFloat, got %v", metrics["fill_rate"])
+	}
+	if _, ok := metrics["collisions"]; !ok {
+		t.Error("collisions should be described")
+	}
+	resizes := metrics["resizes"]
+	if resizes == 0 {
+		t.Error("resizes should be counted")
+	}
+	m.Grow(0)
+	if n := m.DescribeMetrics()["resizes"]; n != resizes+1 {
+		t.Errorf("an explicit resize should be counted once, got %v resizes after %v", n, resizes)
+	}
+}
+
+func TestReindex(t *testing.T) {
+	m := New[int, int](1 << 10)
+	for i := 0; i < 100; i++ {
+		m.Set(i, i)
+	}
+	var (
+		data     = m.metadata.Load()
+		expected = append([]*element[int, int](nil), data.index...)
+		count    = data.count.Load()
+	)
+	// drop every index entry to simulate an index out of sync with the list
+	for i := range data.index {
+		if data.index[i] != nil {
+			data.index[i] = nil
+			data.count.Add(^uintptr(0))
+		}
+	}
+
+	m.Reindex()
+	if !reflect.DeepEqual(data.index, expected) || data.count.Load() != count {
+		t.Error("reindexing should restore the index entries and the counter")
+	}
+	for i := 0; i < 100; i++ {
+		if v, ok := m.Get(i); !ok || v != i {
+			t.Fatalf("key %d should be retrievable after reindexing, got %d %t", i, v, ok)
+		}
+	}
+
+	m.Reindex()
+	if !reflect.DeepEqual(data.index, expected) || data.count.Load() != count {
+		t.Error("reindexing a consistent index should not change it")
+	}
+}
+
+func TestKeyHash(t *testing.T) {
+	m := New[string, int]()
+	if m.KeyHash("key") != DefaultHasher[string]()("key") {
+		t.Error("key hash should be computed by the default hasher")
+	}
+	m.SetHasher(func(key string) uintptr { return uintptr(len(key)) })
+	if h := m.KeyHash("key"); h != 3 {
+		t.Errorf("key hash should be computed by the custom hasher, got %d", h)
+	}
+}
+
+func TestEmptyKeys(t *testing.T) {
+	// xxHash64 of an empty input, the hash is truncated to the width of uintptr on 32-bit platforms
+	var emptySum uint64 = 0xef46db3751d8e999
+	type customString string
+	for _, h := range []uintptr{
+		DefaultHasher[string]()(""),
+		DefaultHasher[string]()(string([]byte{})),
+		DefaultHasher[string]()("ab"[1:1]),
+		DefaultHasher[customString]()(""),
+		uintptr(sum64(nil, 0)),
+		uintptr(sum64([]byte{}, 0)),
+	} {
+		if h != uintptr(emptySum) {
+			t.Errorf("hash of empty input should be %x, got %x", uintptr(emptySum), h)
+		}
+	}
+	if seededHasher[string](1)("") == seededHasher[string](2)("") {
+		t.Error("seeded hash of an empty string should depend on the seed")
+	}
+
+	m := New[string, int]()
+	m.Set("", 1)
+	m.Set(string([]byte{}), 2)
+	if v, ok := m.Get(""); !ok || v != 2 || m.Len() != 1 {
+		t.Errorf("all empty strings should map to the same key, got %d %t with length %d", v, ok, m.Len())
+	}
+	m.Del("")
+	if _, ok := m.Get(""); ok {
+		t.Error("empty string key should be deletable")
+	}
+}
+
+func TestFromMap(t *testing.T) {
+	src := make(map[int]string)
+	for i := 0; i < 1000; i++ {
+		src[i] = strconv.Itoa(i)
+	}
+	m := FromMap(src)
+	if m.Len() != 1000 {
+		t.Fatalf("expected 1000 items, got %d", m.Len())
+	}
+	for key, expected := range src {
+		if v, ok := m.Get(key); !ok || v != expected {
+			t.Fatalf("key %d should map to %q, got %q %t", key, expected, v, ok)
+		}
+	}
+	if size := len(m.metadata.Load().index); size != 2048 {
+		t.Errorf("map should be pre-allocated with 2048 slots, got %d", size)
+	}
+	if r := m.resizes.Load(); r != 1 {
+		t.Errorf("only the initial allocation should happen, got %d resizes", r)
+	}
+	if FromMap(map[int]string{}).Len() != 0 {
+		t.Error("map created from an empty map should be empty")
+	}
+}
+
+func TestValidate(t *testing.T) {
+	m := New[int, int]()
+	if err := m.Validate(); err != nil {
+		t.Errorf("empty map should be valid, got %v", err)
+	}
+	for i := 0; i < 1000; i++ {
+		m.Set(i, i)
+	}
+	m.Del(1, 2, 3)
+	if err := m.Validate(); err != nil {
+		t.Errorf("map should be valid, got %v", err)
+	}
+
+	m.numItems.Add(1)
+	if err := m.Validate(); err == nil || !strings.Contains(err.Error(), "item counter") {
+		t.Errorf("expected a counter violation, got %v", err)
+	}
+	m.numItems.Add(^uintptr(0))
+
+	data := m.metadata.Load()
+	for i, item := range data.index {
+		if item != nil {
+			data.index[i] = &element[int, int]{keyHash: item.keyHash, key: -1}
+			if err := m.Validate(); err == nil || !strings.Contains(err.Error(), "not reachable") {
+				t.Errorf("expected an unreachable index entry, got %v", err)
+			}
+			data.index[i] = item
+			break
+		}
+	}
+
+	first := m.listHead.next()
+	first.keyHash, first.key = ^uintptr(0), -1
+	if err := m.Validate(); err == nil || !strings.Contains(err.Error(), "not sorted") {
+		t.Errorf("expected an ordering violation, got %v", err)
+	}
+}
+
+func TestCompareAndSwapPtr(t *testing.T) {
+	m := New[int, *Animal]()
+	cat, lookalike, tiger := &Animal{"cat"}, &Animal{"cat"}, &Animal{"tiger"}
+	m.Set(1, cat)
+
+	if m.CompareAndSwapPtr(1, lookalike, tiger) {
+		t.Error("pointer to an equal value should not match by identity")
+	}
+	if !m.CompareAndSwap(1, lookalike, cat) {
+		t.Error("CompareAndSwap should still compare the pointed-to values")
+	}
+	if !m.CompareAndSwapPtr(1, cat, tiger) {
+		t.Error("identical pointer should match")
+	}
+	if v, _ := m.Get(1); v != tiger {
+		t.Error("value should have been swapped to tiger")
+	}
+	if m.CompareAndSwapPtr(2, nil, tiger) {
+		t.Error("absent key should not be swapped")
+	}
+
+	n := New[int, int]()
+	n.Set(1, 1)
+	if !n.CompareAndSwapPtr(1, 1, 2) || n.CompareAndSwapPtr(1, 1, 3) {
+		t.Error("non-pointer values should be compared like CompareAndSwap")
+	}
+
+	if !m.CompareAndSwapFunc(1, &Animal{"TIGER"}, cat, func(a, b *Animal) bool { return strings.EqualFold(a.name, b.name) }) {
+		t.Error("custom equality should be used")
+	}
+}
+
+func TestTransformValues(t *testing.T) {
+	m := New[int, int]()
+	for i := 0; i < 1000; i++ {
+		m.Set(i, i)
+	}
+	m.TransformValues(func(k, v int) int { return v * 2 })
+	for i := 0; i < 1000; i++ {
+		if v, _ := m.Get(i); v != i*2 {
+			t.Fatalf("value of key %d should have been doubled, got %d", i, v)
+		}
+	}
+
+	// concurrent increments must not be clobbered by the transform
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for n := 0; n < 100; n++ {
+			for i := 0; i < 1000; i++ {
+				Add(m, i, 1)
+			}
+		}
+	}()
+	m.TransformValues(func(k, v int) int { return v + 1000 })
+	wg.Wait()
+	for i := 0; i < 1000; i++ {
+		if v, _ := m.Get(i); v != i*2+1100 {
+			t.Fatalf("expected %d for key %d, got %d", i*2+1100, i, v)
+		}
+	}
+}
+
+func TestSizeBoundaries(t *testing.T) {
+	const maxSize = uintptr(1) << (strconv.IntSize - 1)
+	for _, c := range []struct{ in, pow2, log uintptr }{
+		{0, 1, 0},
+		{1, 1, 0},
+		{2, 2, 1},
+		{3, 4, 2},
+		{1000, 1024, 10},
+		{maxSize / 2, maxSize / 2, strconv.IntSize - 2},
+		{maxSize/2 + 1, maxSize, strconv.IntSize - 1},
+		{maxSize, maxSize, strconv.IntSize - 1},
+		{maxSize + 1, maxSize, strconv.IntSize},
+		{^uintptr(0), maxSize, strconv.IntSize},
+	} {
+		if p := roundUpPower2(c.in); p != c.pow2 {
+			t.Errorf("roundUpPower2(%d) should be %d, got %d", c.in, c.pow2, p)
+		}
+		if l := log2(c.in); l != c.log {
+			t.Errorf("log2(%d) should be %d, got %d", c.in, c.log, l)
+		}
+	}
+
+	m := New[int, int]()
+	if size := m.grownSize(maxSize); size != maxSize {
+		t.Errorf("grown size should be clamped to %d, got %d", maxSize, size)
+	}
+	if size := m.capacityFor(^uintptr(0)); size != maxSize {
+		t.Errorf("capacity should be clamped to %d, got %d", maxSize, size)
+	}
+	defer func() {
+		if r := recover(); r == nil || !strings.Contains(fmt.Sprint(r), "exceeds the maximum index size") {
+			t.Errorf("expected a panic for a size beyond the maximum, got %v", r)
+		}
+		if m.resizing.Load() != notResizing {
+			t.Error("a rejected Grow should not leave the map resizing")
+		}
+	}()
+	m.Grow(maxSize + 1)
+}
+
+func TestSetSlices(t *testing.T) {
+	m := New[int, int]()
+	m.Set(1, -1)
+	keys := make([]int, 1000)
+	values := make([]int, 1000)
+	for i := range keys {
+		keys[i], values[i] = i, i*2
+	}
+	keys[999], values[999] = 5, 42 // duplicate key, the last value wins
+
+	m.SetSlices(keys, values)
+	if m.Len() != 999 {
+		t.Fatalf("expected 999 items, got %d", m.Len())
+	}
+	for i := 0; i < 999; i++ {
+		expected := i * 2
+		if i == 5 {
+			expected = 42
+		}
+		if v, ok := m.Get(i); !ok || v != expected {
+			t.Fatalf("key %d should map to %d, got %d %t", i, expected, v, ok)
+		}
+	}
+	values[0] = -100
+	if v, _ := m.Get(0); v != 0 {
+		t.Error("map should not alias the values slice")
+	}
+
+	defer func() {
+		if r := recover(); r == nil || !strings.Contains(fmt.Sprint(r), "2 keys but 1 values") {
+			t.Errorf("expected a panic for slices of different lengths, got %v", r)
+		}
+	}()
+	m.SetSlices([]int{1, 2}, []int{1})
+}
+
+func TestIsResizing(t *testing.T) {
+	m := New[int, int]()
+	if m.IsResizing() {
+		t.Error("new map should not be resizing")
+	}
+	m.resizing.Store(resizingInProgress)
+	if !m.IsResizing() {
+		t.Error("map should report an ongoing resize")
+	}
+	m.resizing.Store(notResizing)
+
+	m.OnResize(func(uintptr, uintptr) {
+		if m.IsResizing() {
+			t.Error("map should not be resizing once the resize completed")
+		}
+	})
+	m.Grow(0)
+}
+
+func TestSetCopy(t *testing.T) {
+	m := New[string, []byte]()
+	buf := []byte("hello")
+
+	m.Set("aliased", buf)
+	SetCopy(m, "copied", buf)
+	copy(buf, "HELLO")
+
+	if v, _ := m.Get("aliased"); string(v) != "HELLO" {
+		t.Errorf("Set should alias the caller's buffer, got %q", v)
+	}
+	if v, _ := m.Get("copied"); string(v) != "hello" {
+		t.Errorf("SetCopy should not alias the caller's buffer, got %q", v)
+	}
+
+	SetCopy(m, "nil", nil)
+	SetCopy(m, "empty", []byte{})
+	if v, ok := m.Get("nil"); !ok || v != nil {
+		t.Error("nil slice should be stored as nil")
+	}
+	if v, ok := m.Get("empty"); !ok || v == nil || len(v) != 0 {
+		t.Error("empty slice should be stored as a non-nil empty slice")
+	}
+}
+
+func TestParallelForEach(t *testing.T) {
+	m := New[int, int](64)
+	// runs of colliding hashes straddle the boundaries between ranges of slots
+	m.SetHasher(func(key int) uintptr { return uintptr(key/3) << (strconv.IntSize - 7) })
+	for i := 1; i <= 300; i++ {
+		m.Set(i, i)
+	}
+	m.Del(10)
+
+	for _, workers := range []int{-1, 1, 3, 7, 64, 1000} {
+		var (
+			mu    sync.Mutex
+			seen  = make(map[int]int)
+			total int64
+		)
+		m.ParallelForEach(workers, func(k, v int) {
+			atomic.AddInt64(&total, int64(v))
+			mu.Lock()
+			seen[k]++
+			mu.Unlock()
+		})
+		if len(seen) != 299 || total != 300*301/2-10 {
+			t.Fatalf("%d workers: expected 299 pairs summing up to %d, got %d summing up to %d", workers, 300*301/2-10, len(seen), total)
+		}
+		for k, n := range seen {
+			if n != 1 {
+				t.Fatalf("%d workers: key %d visited %d times", workers, k, n)
+			}
+		}
+	}
+
+	New[int, int]().ParallelForEach(4, func(int, int) {
+		t.Error("lambda should not be called for an empty map")
+	})
+}
+
+func TestReplaceAll(t *testing.T) {
+	m := New[int, string]()
+	for i := 0; i < 100; i++ {
+		m.Set(i, "old")
+	}
+	m.Del(50)
+
+	entries := map[int]string{}
+	for i := 0; i < 200; i += 2 {
+		entries[i] = "new"
+	}
+	m.ReplaceAll(entries, false)
+	if m.Len() != 99 {
+		t.Errorf("absent keys should be ignored, got length %d", m.Len())
+	}
+	for i := 0; i < 100; i++ {
+		expected := "old"
+		if i%2 == 0 {
+			expected = "new"
+		}
+		if v, ok := m.Get(i); i != 50 && (!ok || v != expected) {
+			t.Fatalf("key %d should map to %q, got %q %t", i, expected, v, ok)
+		}
+	}
+	if _, ok := m.Get(50); ok {
+		t.Error("deleted key should not be replaced")
+	}
+
+	m.ReplaceAll(entries, true)
+	if m.Len() != 150 {
+		t.Errorf("absent keys should be inserted, got length %d", m.Len())
+	}
+	for i := 0; i < 200; i += 2 {
+		if v, ok := m.Get(i); !ok || v != "new" {
+			t.Fatalf("key %d should map to \"new\", got %q %t", i, v, ok)
+		}
+	}
+	m.ReplaceAll(nil, true)
+}
+
+func TestGetWithBucket(t *testing.T) {
+	m := New[int, int](8)
+	m.SetHasher(func(key int) uintptr { return uintptr(key) << (strconv.IntSize - 4) })
+	m.Set(5, 50)
+
+	if v, bucket, ok := m.GetWithBucket(5); !ok || v != 50 || bucket != 2 {
+		t.Errorf("expected value 50 in bucket 2, got %d in bucket %d %t", v, bucket, ok)
+	}
+	if _, bucket, ok := m.GetWithBucket(7); ok || bucket != 3 {
+		t.Errorf("absent key should resolve to bucket 3, got bucket %d %t", bucket, ok)
+	}
+	m.Grow(16)
+	if _, bucket, _ := m.GetWithBucket(5); bucket != 5 {
+		t.Errorf("key should resolve to bucket 5 after resizing, got %d", bucket)
+	}
+}
+
+func TestUseClassicStringHash(t *testing.T) {
+	m := New[string, int]()
+	m.SetSeededHasher(7)
+	m.UseClassicStringHash()
+	// reference XXH64 digest of "abc" with seed 0, truncated to the word size
+	digest := uint64(0x44bc2cf5ad770999)
+	if h := m.KeyHash("abc"); h != uintptr(digest) {
+		t.Errorf("expected the classic xxHash digest, got %x", h)
+	}
+	m.Set("abc", 1)
+	if v, ok := m.Get("abc"); !ok || v != 1 {
+		t.Error("key missing after switching to the classic hasher")
+	}
+
+	func() {
+		defer func() {
+			if recover() == nil {
+				t.Error("expected panic on a non-empty map")
+			}
+		}()
+		m.UseClassicStringHash()
+	}()
+	func() {
+		defer func() {
+			if recover() == nil {
+				t.Error("expected panic for non-string keys")
+			}
+		}()
+		New[int, int]().UseClassicStringHash()
+	}()
+}
+
+func TestForEachSorted(t *testing.T) {
+	m := New[int, int]()
+	for i := 1; i <= 100; i++ {
+		m.Set(i, i*10)
+	}
+	m.Del(10, 20, 30)
+
+	var keys []int
+	m.ForEachSorted(func(a, b int) bool { return a < b }, func(key, value int) bool {
+		if value != key*10 {
+			t.Errorf("wrong value %d for key %d", value, key)
+		}
+		keys = append(keys, key)
+		return true
+	})
+	if len(keys) != 97 || !sort.IntsAreSorted(keys) {
+		t.Fatalf("expected 97 keys in ascending order, got %v", keys)
+	}
+
+	keys = keys[:0]
+	m.ForEachSorted(func(a, b int) bool { return a > b }, func(key, value int) bool {
+		keys = append(keys, key)
+		return len(keys) < 3
+	})
+	if len(keys) != 3 || keys[0] != 100 || keys[1] != 99 || keys[2] != 98 {
+		t.Errorf("expected to stop after the 3 largest keys, got %v", keys)
+	}
+}
+
+func TestDeleteHashRange(t *testing.T) {
+	m := New[int, int](64)
+	m.SetHasher(func(key int) uintptr { return uintptr(key) << (strconv.IntSize - 8) })
+	for i := 1; i < 200; i++ {
+		m.Set(i, i)
+	}
+
+	m.DeleteHashRange(m.KeyHash(50), m.KeyHash(149))
+	if m.Len() != 99 {
+		t.Errorf("expected 99 remaining items, got %d", m.Len())
+	}
+	for i := 1; i < 200; i++ {
+		if _, ok := m.Get(i); ok == (i >= 50 && i <= 149) {
+			t.Errorf("wrong presence %t for key %d", ok, i)
+		}
+	}
+	if err := m.Validate(); err != nil {
+		t.Error(err)
+	}
+
+	m.DeleteHashRange(m.KeyHash(190), m.KeyHash(180))
+	m.DeleteHashRange(m.KeyHash(60), m.KeyHash(140))
+	if m.Len() != 99 {
+		t.Errorf("empty or inverted ranges should not delete anything, got %d items", m.Len())
+	}
+}
+
+func TestNewLazy(t *testing.T) {
+	m := NewLazy[int, int]()
+	if m.metadata.Load() != nil {
+		t.Fatal("lazily created map should not hold an index before the first insertion")
+	}
+	if _, ok := m.Get(1); ok {
+		t.Error("lookup on an unallocated map should return absent")
+	}
+	m.Del(1)
+	m.ForEach(func(int, int) bool {
+		t.Error("unallocated map should be empty")
+		return false
+	})
+	if m.Len() != 0 || m.Fillrate() != 0 || m.BucketSizes() != nil || m.Validate() != nil {
+		t.Error("unallocated map should report an empty state")
+	}
+	if m.metadata.Load() != nil {
+		t.Fatal("reads should not allocate the index")
+	}
+
+	var wg sync.WaitGroup
+	for i := 1; i <= 8; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			m.Set(i, i)
+		}(i)
+	}
+	wg.Wait()
+	if m.metadata.Load() == nil {
+		t.Fatal("first insertion should allocate the index")
+	}
+	for i := 1; i <= 8; i++ {
+		if v, ok := m.Get(i); !ok || v != i {
+			t.Errorf("key %d missing after concurrent first insertions", i)
+		}
+	}
+	if err := m.Validate(); err != nil {
+		t.Error(err)
+	}
+
+	m = NewLazy[int, int]()
+	m.Grow(0)
+	if size := len(m.metadata.Load().index); size != defaultSize {
+		t.Errorf("growing an unallocated map should allocate the default size, got %d", size)
+	}
+}
+
+func TestWriteLog(t *testing.T) {
+	m := New[int, int]()
+	m.Set(1, 1)
+	if m.DumpWriteLog() != nil {
+		t.Error("write log should be disabled by default")
+	}
+
+	m.EnableWriteLog(4)
+	m.Set(2, 2)
+	m.Set(2, 3)
+	m.Del(2)
+	if entries := m.DumpWriteLog(); len(entries) != 3 ||
+		entries[0] != (LogEntry[int]{Seq: 0, Op: LogSet, Key: 2, Goroutine: entries[0].Goroutine}) ||
+		entries[2].Op != LogDel || entries[2].Seq != 2 || entries[0].Goroutine == 0 {
+		t.Errorf("unexpected write log %v", entries)
+	}
+
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for j := 0; j < 100; j++ {
+				m.Set(i*100+j, j)
+			}
+		}(i)
+	}
+	wg.Wait()
+	entries := m.DumpWriteLog()
+	if len(entries) != 4 || entries[0].Seq != 399 {
+		t.Fatalf("write log should retain only the 4 most recent writes, got %v", entries)
+	}
+	for i := 1; i < len(entries); i++ {
+		if entries[i].Seq != entries[i-1].Seq+1 {
+			t.Errorf("write log entries out of order %v", entries)
+		}
+	}
+
+	m.EnableWriteLog()
+	if len(m.DumpWriteLog()) != 0 {
+		t.Error("re-enabling the write log should discard previous entries")
+	}
+	if LogDel.String() != "del" || LogOp(9).String() != "LogOp(9)" {
+		t.Error("unexpected names of log operations")
+	}
+}
+
+func TestCompact(t *testing.T) {
+	m := NewWithOptions(WithInsertionOrder[int, int]())
+	for i := 1; i <= 1000; i++ {
+		m.Set(i, i)
+	}
+	for i := 1; i <= 1000; i += 2 {
+		m.Del(i)
+	}
+	m.SetWithTTL(2000, 2000, time.Nanosecond)
+
+	m.Compact()
+	if err := m.Validate(); err != nil {
+		t.Fatal(err)
+	}
+	if m.Len() != 501 {
+		t.Errorf("expected 501 items after compaction, got %d", m.Len())
+	}
+	for i := 1; i <= 1000; i++ {
+		if v, ok := m.Get(i); ok != (i%2 == 0) || (ok && v != i) {
+			t.Errorf("wrong state of key %d after compaction", i)
+		}
+	}
+	if _, ok := m.Get(2000); ok {
+		t.Error("compaction should retain the expiry of entries")
+	}
+
+	prev := 0
+	m.ForEachOrdered(func(key, _ int) bool {
+		if key <= prev {
+			t.Fatalf("insertion order not retained, %d visited after %d", key, prev)
+		}
+		prev = key
+		return true
+	})
+
+	m.Set(1, 1)
+	m.Del(4)
+	if _, ok := m.Get(1); !ok || m.Len() != 501 {
+		t.Error("map should remain writable after compaction")
+	}
+	if err := m.Validate(); err != nil {
+		t.Error(err)
+	}
+
+	m.Clear()
+	m.Compact()
+	if m.Len() != 0 || m.Validate() != nil {
+		t.Error("compacting an empty map should keep it empty")
+	}
+}
+
+func BenchmarkForEachCompact(b *testing.B) {
+	const size = 1 << 20
+	m := New[int, int](size)
+	for _, i := range rand.Perm(size) {
+		m.Set(i, i)
+	}
+	bench := func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			sum := 0
+			m.ForEach(func(_, value int) bool {
+				sum += value
+				return true
+			})
+		}
+	}
+	b.Run("scattered", bench)
+	m.Compact()
+	b.Run("compacted", bench)
+}
+
+func TestGetConsistent(t *testing.T) {
+	m := New[int, int]()
+	for i := 1; i <= 1000; i++ {
+		m.Set(i, i)
+	}
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		m.Grow(1 << 16)
+	}()
+	for i := 1; i <= 1000; i++ {
+		if v, ok := m.GetConsistent(i); !ok || v != i {
+			t.Errorf("key %d missing during concurrent resize", i)
+		}
+	}
+	<-done
+
+	// a resize which never finishes falls back to scanning the list
+	m.resizing.Store(resizingInProgress)
+	if v, ok := m.GetConsistent(500); !ok || v != 500 {
+		t.Error("key missing while the resize flag is stuck")
+	}
+	if _, ok := m.GetConsistent(5000); ok {
+		t.Error("absent key should not be found while the resize flag is stuck")
+	}
+	m.resizing.Store(notResizing)
+}
+
+func TestFilter(t *testing.T) {
+	m := New[int, int]()
+	for i := 0; i < 100; i++ {
+		m.Set(i, i*2)
+	}
+	m.Del(10, 20)
+
+	even := m.Filter(func(key, value int) bool { return key%10 == 0 && value == key*2 })
+	if len(even) != 8 {
+		t.Fatalf("expected 8 matching entries, got %d", len(even))
+	}
+	for key, value := range even {
+		if key%10 != 0 || key == 10 || key == 20 || value != key*2 {
+			t.Errorf("unexpected entry %d:%d", key, value)
+		}
+	}
+	if len(m.Filter(func(int, int) bool { return false })) != 0 {
+		t.Error("no entry should match a predicate which is always false")
+	}
+}
+
+func TestSetX(t *testing.T) {
+	m := New[int, int](8)
+	var resizes int
+	for i := 1; i <= 100; i++ {
+		created, resized := m.SetX(i, i)
+		if !created {
+			t.Errorf("key %d should be newly inserted", i)
+		}
+		if resized {
+			resizes++
+		}
+	}
+	if resizes == 0 || uintptr(resizes) != m.resizes.Load()-1 {
+		t.Errorf("expected every resize after the initial allocation to be reported, got %d of %d", resizes, m.resizes.Load()-1)
+	}
+
+	if created, resized := m.SetX(1, 10); created || resized {
+		t.Error("updating a present key should neither insert nor resize")
+	}
+	if v, _ := m.Get(1); v != 10 {
+		t.Errorf("expected updated value 10, got %d", v)
+	}
+}
+
+func TestCompareAndSwapFuncValues(t *testing.T) {
+	type handler struct {
+		name string
+		fn   func() int
+	}
+	m := New[int, handler]()
+	m.Set(1, handler{name: "a"})
+	if !m.CompareAndSwap(1, handler{name: "a"}, handler{name: "b"}) {
+		t.Error("CompareAndSwap should succeed for values holding nil functions")
+	}
+
+	h := handler{name: "c", fn: func() int { return 1 }}
+	m.Set(1, h)
+	if m.CompareAndSwap(1, h, handler{name: "d"}) {
+		t.Error("CompareAndSwap should fail for values holding non-nil functions")
+	}
+	if !m.CompareAndSwapFunc(1, h, handler{name: "d"}, func(a, b handler) bool { return a.name == b.name }) {
+		t.Error("CompareAndSwapFunc should work for values holding functions")
+	}
+
+	// functions behind pointers are compared by identity and remain supported
+	p := &h
+	mp := New[int, *handler]()
+	mp.Set(1, p)
+	if !mp.CompareAndSwap(1, p, &handler{name: "e"}) {
+		t.Error("CompareAndSwap should work for pointers to values holding functions")
+	}
+}
+
+func TestEntries(t *testing.T) {
+	m := New[int, string]()
+	for i := 0; i < 50; i++ {
+		m.Set(i, strconv.Itoa(i))
+	}
+	m.Del(7)
+
+	entries := m.Entries()
+	if len(entries) != 49 {
+		t.Fatalf("expected 49 entries, got %d", len(entries))
+	}
+	for _, e := range entries {
+		if e.Key == 7 || e.Value != strconv.Itoa(e.Key) {
+			t.Errorf("unexpected entry %v", e)
+		}
+	}
+}
+
+func TestSetIfGreaterLess(t *testing.T) {
+	m := New[string, int]()
+	if !SetIfGreater(m, "max", 5) || !SetIfLess(m, "min", 5) {
+		t.Error("absent keys should be stored")
+	}
+	if SetIfGreater(m, "max", 3) || SetIfGreater(m, "max", 5) || !SetIfGreater(m, "max", 7) {
+		t.Error("only greater values should be stored")
+	}
+	if SetIfLess(m, "min", 7) || SetIfLess(m, "min", 5) || !SetIfLess(m, "min", 3) {
+		t.Error("only lesser values should be stored")
+	}
+
+	var wg sync.WaitGroup
+	for g := 0; g < 8; g++ {
+		wg.Add(1)
+		go func(g int) {
+			defer wg.Done()
+			for i := 0; i < 1000; i++ {
+				SetIfGreater(m, "max", g*1000+i)
+				SetIfLess(m, "min", -(g*1000 + i))
+				SetIfGreater(m, "fresh", i)
+			}
+		}(g)
+	}
+	wg.Wait()
+	if v, _ := m.Get("max"); v != 7999 {
+		t.Errorf("expected max 7999, got %d", v)
+	}
+	if v, _ := m.Get("min"); v != -7999 {
+		t.Errorf("expected min -7999, got %d", v)
+	}
+	if v, _ := m.Get("fresh"); v != 999 {
+		t.Errorf("expected max 999 for a key inserted concurrently, got %d", v)
+	}
+}
+
+func TestMemoryUsage(t *testing.T) {
+	m := New[int, int](1024)
+	empty := m.MemoryUsage()
+	if index := uintptr(1024) * unsafe.Sizeof(uintptr(0)); empty < index {
+		t.Errorf("usage %d should include the index of %d bytes", empty, index)
+	}
+
+	for i := 1; i <= 100; i++ {
+		m.Set(i, i)
+	}
+	node := unsafe.Sizeof(element[int, int]{}) + unsafe.Sizeof(valueBox[int]{})
+	if grown := m.MemoryUsage(); grown != empty+100*node {
+		t.Errorf("expected usage %d for 100 nodes, got %d", empty+100*node, grown)
+	}
+}
+
+// features like TTLs, versions or the insertion order must not grow the elements of maps which do not use them
+func TestElementSize(t *testing.T) {
+	if size, word := unsafe.Sizeof(element[uintptr, uintptr]{}), unsafe.Sizeof(uintptr(0)); size != 4*word {
+		t.Errorf("element should consist of its key hash, key, next and value pointers only, got %d bytes", size)
+	}
+}
+
+func TestGetAndRefresh(t *testing.T) {
+	m := New[string, int]()
+	m.SetWithTTL("a", 1, 200*time.Millisecond)
+	m.Set("b", 2)
+
+	// the total sleep exceeds the TTL whereas every single sleep stays well below it
+	for i := 0; i < 5; i++ {
+		time.Sleep(50 * time.Millisecond)
+		if v, ok := m.GetAndRefresh("a", 200*time.Millisecond); !ok || v != 1 {
+			t.Fatalf("refreshed entry should not expire, got %d %t", v, ok)
+		}
+	}
+
+	if v, ok := m.GetAndRefresh("b", time.Millisecond); !ok || v != 2 {
+		t.Error("entry without expiry should be found")
+	}
+	time.Sleep(5 * time.Millisecond)
+	if _, ok := m.Get("b"); ok {
+		t.Error("refreshing an entry without expiry should give it one")
+	}
+	if _, ok := m.GetAndRefresh("b", time.Hour); ok {
+		t.Error("expired entries should not be revived")
+	}
+	if _, ok := m.GetAndRefresh("c", time.Hour); ok {
+		t.Error("absent key should not be found")
+	}
+}
+
+func TestRemoveWhile(t *testing.T) {
+	m := New[int, int]()
+	m.SetHasher(func(key int) uintptr { return uintptr(key) })
+	for i := 1; i <= 100; i++ {
+		m.Set(i, i)
+	}
+
+	visited := 0
+	removed := m.RemoveWhile(func(key, _ int) bool {
+		visited++
+		return key <= 30
+	})
+	if removed != 30 || visited != 31 || m.Len() != 70 {
+		t.Errorf("expected 30 removed after 31 visits with 70 left, got %d %d %d", removed, visited, m.Len())
+	}
+	if _, ok := m.Get(30); ok {
+		t.Error("key 30 should be removed")
+	}
+	if _, ok := m.Get(31); !ok {
+		t.Error("key 31 should be retained")
+	}
+	if removed := m.RemoveWhile(func(int, int) bool { return true }); removed != 70 || m.Len() != 0 {
+		t.Errorf("expected all 70 remaining entries removed, got %d", removed)
+	}
+}
+
+func TestSingleThreadedMap(t *testing.T) {
+	m := NewSingleThreaded[string, int](1)
+	ref := make(map[string]int)
+	r := rand.New(rand.NewSource(1))
+	for i := 0; i < 100000; i++ {
+		key := strconv.Itoa(r.Intn(2000))
+		switch r.Intn(3) {
+		case 0:
+			m.Set(key, i)
+			ref[key] = i
+		case 1:
+			m.Del(key)
+			delete(ref, key)
+		default:
+			v, ok := m.Get(key)
+			if rv, rok := ref[key]; ok != rok || v != rv {
+				t.Fatalf("key %s: got %d %t, expected %d %t", key, v, ok, rv, rok)
+			}
+		}
+	}
+	if m.Len() != uintptr(len(ref)) {
+		t.Fatalf("expected %d entries, got %d", len(ref), m.Len())
+	}
+	seen := 0
+	m.ForEach(func(key string, value int) bool {
+		if ref[key] != value {
+			t.Errorf("unexpected pair %s:%d", key, value)
+		}
+		seen++
+		return true
+	})
+	if seen != len(ref) {
+		t.Errorf("expected to visit %d pairs, visited %d", len(ref), seen)
+	}
+
+	if v, loaded := m.GetOrSet("new", 1); loaded || v != 1 {
+		t.Error("absent key should be stored")
+	}
+	if v, loaded := m.GetOrSet("new", 2); !loaded || v != 1 {
+		t.Error("present key should be loaded")
+	}
+	m.SetHasher(func(key string) uintptr { return uintptr(len(key)) })
+	if v, ok := m.Get("new"); !ok || v != 1 {
+		t.Error("entries should be re-hashed with the new hasher")
+	}
+	m.Clear()
+	if _, ok := m.Get("new"); ok || m.Len() != 0 {
+		t.Error("cleared map should be empty")
+	}
+}
+
+func BenchmarkSingleThreaded(b *testing.B) {
+	const size = 1 << 12
+	b.Run("haxmap", func(b *testing.B) {
+		m := New[uintptr, uintptr]()
+		for i := 0; i < b.N; i++ {
+			key := uintptr(i % size)
+			m.Set(key, key)
+			m.Get(key)
+		}
+	})
+	b.Run("single-threaded", func(b *testing.B) {
+		m := NewSingleThreaded[uintptr, uintptr]()
+		for i := 0; i < b.N; i++ {
+			key := uintptr(i % size)
+			m.Set(key, key)
+			m.Get(key)
+		}
+	})
+}
+
+func TestCapacity(t *testing.T) {
+	if c := New[int, int](1000).Capacity(); c != 1024 {
+		t.Errorf("New(1000) should round up to 1024 slots, got %d", c)
+	}
+	if c := New[int, int](1024).Capacity(); c != 1024 {
+		t.Errorf("New(1024) should keep 1024 slots, got %d", c)
+	}
+	if c := New[int, int]().Capacity(); c != defaultSize {
+		t.Errorf("expected default capacity %d, got %d", defaultSize, c)
+	}
+	if c := NewLazy[int, int]().Capacity(); c != 0 {
+		t.Errorf("lazily created map should have no capacity, got %d", c)
+	}
+
+	m := New[int, int]()
+	m.Grow(3000)
+	if c := m.Capacity(); c != 4096 {
+		t.Errorf("Grow(3000) should round up to 4096 slots, got %d", c)
+	}
+}
+
+func TestContainsAll(t *testing.T) {
+	m := New[int, int]()
+	// colliding hashes for pairs of keys
+	m.SetHasher(func(key int) uintptr { return uintptr(key/2) << (strconv.IntSize - 8) })
+	for i := 0; i < 100; i += 3 {
+		m.Set(i, i)
+	}
+	m.SetWithTTL(1000, 0, -time.Second)
+
+	keys := []int{99, 1000, 5, 3, 4, 0, 2, 98, 500, 3}
+	found := m.ContainsAll(keys...)
+	for i, key := range keys {
+		_, ok := m.Get(key)
+		if found[i] != ok {
+			t.Errorf("presence of key %d reported as %t", key, found[i])
+		}
+	}
+	if len(m.ContainsAll()) != 0 {
+		t.Error("expected an empty result without keys")
+	}
+}
+
+func TestRangeCollect(t *testing.T) {
+	m := New[int, int]()
+	for i := 0; i < 10; i++ {
+		m.Set(i, i)
+	}
+	visited := 0
+	errs := m.RangeCollect(func(key, value int) error {
+		visited++
+		if value%3 == 0 {
+			return fmt.Errorf("bad value %d", value)
+		}
+		return nil
+	})
+	if visited != 10 || len(errs) != 4 {
+		t.Errorf("expected 10 visits and 4 errors, got %d and %v", visited, errs)
+	}
+	if errs := m.RangeCollect(func(int, int) error { return nil }); errs != nil {
+		t.Errorf("expected nil without errors, got %v", errs)
+	}
+}
+
+func TestGetOrCreateSubmap(t *testing.T) {
+	m := New[string, *Map[int, int]]()
+	var wg sync.WaitGroup
+	for g := 0; g < 8; g++ {
+		wg.Add(1)
+		go func(g int) {
+			defer wg.Done()
+			for i := 0; i < 100; i++ {
+				GetOrCreateSubmap(m, "users").Set(g*100+i, i)
+			}
+		}(g)
+	}
+	wg.Wait()
+
+	if m.Len() != 1 {
+		t.Fatalf("expected a single submap, got %d", m.Len())
+	}
+	if sub := GetOrCreateSubmap(m, "users"); sub.Len() != 800 {
+		t.Errorf("writes to discarded submaps were lost, got %d of 800 entries", sub.Len())
+	}
+}
+
+func TestSetReportAlloc(t *testing.T) {
+	m := New[int, int]()
+	if !m.SetReportAlloc(1, 1) {
+		t.Error("inserting an absent key should allocate a node")
+	}
+	if m.SetReportAlloc(1, 2) {
+		t.Error("updating a present key should not allocate a node")
+	}
+	m.SetWithTTL(2, 2, -time.Second)
+	if m.SetReportAlloc(2, 3) {
+		t.Error("overwriting an expired entry should reuse its node")
+	}
+	m.Del(1)
+	if !m.SetReportAlloc(1, 3) {
+		t.Error("re-inserting a deleted key should allocate a node")
+	}
+	if m.Len() != 2 {
+		t.Errorf("expected 2 entries, got %d", m.Len())
+	}
+}
+
+func TestSetHasherConcurrent(t *testing.T) {
+	m := New[int, int]()
+	for i := 0; i < 100; i++ {
+		m.Set(i, i)
+	}
+	identity := func(key int) uintptr { return uintptr(key) }
+	def := DefaultHasher[int]()
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < 1000; i++ {
+			if i%2 == 0 {
+				m.SetHasher(identity)
+			} else {
+				m.SetHasher(def)
+			}
+		}
+	}()
+	for i := 0; i < 10000; i++ {
+		m.Get(i % 100) // results are undefined while hashers are mixed, the call just must not crash
+	}
+	<-done
+
+	m.SetHasher(def)
+	for i := 0; i < 100; i++ {
+		if v, ok := m.Get(i); !ok || v != i {
+			t.Errorf("key %d missing after restoring the original hasher", i)
+		}
+	}
+}
+
+func TestSplit(t *testing.T) {
+	m := New[int, int]()
+	for i := 0; i < 1000; i++ {
+		m.Set(i, i)
+	}
+
+	shards := m.Split(3)
+	var total uintptr
+	for i, shard := range shards {
+		total += shard.Len()
+		shard.ForEach(func(key, value int) bool {
+			if s, _ := bits.Mul(uint(m.KeyHash(key)), 3); int(s) != i || value != key {
+				t.Errorf("key %d in shard %d belongs to shard %d", key, i, s)
+			}
+			return true
+		})
+		if err := shard.Validate(); err != nil {
+			t.Error(err)
+		}
+		if shard.Len() < 200 {
+			t.Errorf("shard %d holds only %d entries", i, shard.Len())
+		}
+	}
+	if total != 1000 || m.Len() != 1000 {
+		t.Errorf("expected 1000 entries over all shards, got %d", total)
+	}
+
+	if shards := m.Split(1); len(shards) != 1 || shards[0].Len() != 1000 {
+		t.Error("a single shard should hold all entries")
+	}
+	defer func() {
+		if recover() == nil {
+			t.Error("expected panic for 0 shards")
+		}
+	}()
+	m.Split(0)
+}
+
+func TestMergeShards(t *testing.T) {
+	m := New[int, int]()
+	for i := 0; i < 1000; i++ {
+		m.Set(i, i)
+	}
+
+	merged := MergeShards(m.Split(4))
+	if !merged.Equal(m, func(a, b int) bool { return a == b }) {
+		t.Error("merging the shards should restore the map")
+	}
+	// the initial allocation and the pre-allocation for all entries
+	if merged.resizes.Load() != 2 {
+		t.Errorf("merging should not resize while inserting, got %d resizes", merged.resizes.Load())
+	}
+	if err := merged.Validate(); err != nil {
+		t.Error(err)
+	}
+
+	a, b := New[string, int](), New[string, int]()
+	a.Set("x", 1)
+	b.Set("x", 2)
+	if v, _ := MergeShards([]*Map[string, int]{a, b}).Get("x"); v != 2 {
+		t.Errorf("the last shard should win on overlapping keys, got %d", v)
+	}
+	if MergeShards[int, int](nil).Len() != 0 {
+		t.Error("merging no shards should yield an empty map")
+	}
+}
+
+func TestCASBackoff(t *testing.T) {
+	defer SetCASBackoff(defaultCASBackoff)
+	for _, attempts := range []uint32{0, 1} {
+		SetCASBackoff(attempts)
+		m := New[int, int]()
+		var wg sync.WaitGroup
+		for g := 0; g < 16; g++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				for i := 0; i < 1000; i++ {
+					m.Set(i%8, i)
+					m.Del((i + 4) % 8)
+				}
+			}()
+		}
+		wg.Wait()
+		if err := m.Validate(); err != nil {
+			t.Errorf("backoff after %d attempts: %v", attempts, err)
+		}
+	}
+}
+
+func BenchmarkContendedSet(b *testing.B) {
+	defer SetCASBackoff(defaultCASBackoff)
+	for _, attempts := range []uint32{0, defaultCASBackoff} {
+		b.Run(fmt.Sprintf("backoff-%d", attempts), func(b *testing.B) {
+			SetCASBackoff(attempts)
+			m := New[int, int]()
+			var key int32
+			b.SetParallelism(64)
+			b.RunParallel(func(pb *testing.PB) {
+				for pb.Next() {
+					i := int(atomic.AddInt32(&key, 1))
+					m.Set(i%16, i)
+					m.Del((i + 8) % 16)
+				}
+			})
+		})
+	}
+}
+
+func TestCountFunc(t *testing.T) {
+	m := New[int, int]()
+	for i := 0; i < 100; i++ {
+		m.Set(i, i)
+	}
+	m.Del(0, 2)
+
+	even := func(_, value int) bool { return value%2 == 0 }
+	if n := m.CountFunc(even); n != 48 {
+		t.Errorf("expected 48 even values, got %d", n)
+	}
+	if allocs := testing.AllocsPerRun(10, func() { m.CountFunc(even) }); allocs != 0 {
+		t.Errorf("CountFunc should not allocate, got %v allocations", allocs)
+	}
+}
+
+func TestReadView(t *testing.T) {
+	t.Run("frozen", func(t *testing.T) {
+		m := NewWithOptions(WithReadViews[int, int]())
+		for i := 0; i < 100; i++ {
+			m.Set(i, i)
+		}
+		view := m.BeginReadView()
+		defer view.Close()
+
+		m.Set(0, -1)
+		m.Set(100, 100)
+		m.Del(1)
+		Add(m, 2, 10)
+		m.CompareAndSwap(3, 3, -3)
+
+		for key, want := range map[int]int{0: 0, 1: 1, 2: 2, 3: 3} {
+			if value, ok := view.Get(key); !ok || value != want {
+				t.Errorf("key %d: expected %d, got %d (ok %t)", key, want, value, ok)
+			}
+		}
+		if _, ok := view.Get(100); ok {
+			t.Error("key inserted after opening the view is visible")
+		}
+		if n := view.Len(); n != 100 {
+			t.Errorf("expected 100 entries within the view, got %d", n)
+		}
+		view.ForEach(func(key, value int) bool {
+			if key != value {
+				t.Errorf("key %d: expected %d, got %d", key, key, value)
+			}
+			return true
+		})
+		if value, _ := m.Get(0); value != -1 {
+			t.Errorf("expected the map to hold -1, got %d", value)
+		}
+	})
+
+	t.Run("closed", func(t *testing.T) {
+		m := NewWithOptions(WithReadViews[int, int]())
+		m.Set(1, 1)
+		view := m.BeginReadView()
+		view.Close()
+		if _, ok := view.Get(1); ok || view.Len() != 0 {
+			t.Error("closed view is not empty")
+		}
+		// writes after closing all views must not copy anything
+		m.Set(2, 2)
+		if m.views.pending.Load() != 0 || len(m.views.views) != 0 {
+			t.Error("closed view is still registered")
+		}
+	})
+
+	t.Run("disabled", func(t *testing.T) {
+		defer func() {
+			if recover() == nil {
+				t.Error("expected a panic for a map without read views")
+			}
+		}()
+		New[int, int]().BeginReadView()
+	})
+
+	t.Run("concurrent writers", func(t *testing.T) {
+		const keys = 64
+		m := NewWithOptions(WithReadViews[int, int]())
+		for i := 0; i < keys; i++ {
+			m.Set(i, 0)
+		}
+		var (
+			round int64
+			stop  = make(chan struct{})
+			wg    sync.WaitGroup
+		)
+		// every round sets all keys to the same value, so a coherent view holds a single value for all keys
+		// apart from the keys of the round in progress
+		for w := 0; w < 4; w++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				for {
+					select {
+					case <-stop:
+						return
+					default:
+					}
+					r := int(atomic.AddInt64(&round, 1))
+					for i := 0; i < keys; i++ {
+						m.Set(i, r)
+					}
+				}
+			}()
+		}
+		for i := 0; i < 200; i++ {
+			view := m.BeginReadView()
+			first := make(map[int]int)
+			view.ForEach(func(key, value int) bool {
+				first[key] = value
+				return true
+			})
+			for key, value := range first {
+				if got, ok := view.Get(key); !ok || got != value {
+					t.Fatalf("key %d: view changed from %d to %d", key, value, got)
+				}
+			}
+			if n := view.Len(); n != keys {
+				t.Fatalf("expected %d entries within the view, got %d", keys, n)
+			}
+			view.Close()
+		}
+		close(stop)
+		wg.Wait()
+	})
+}
@@ -2,4 +2,4 @@ module github.com/alphadose/haxmap
 
 go 1.18
 
-require golang.org/x/exp v0.0.0-20221031165847-c99f073a8326 // indirect
+require golang.org/x/exp v0.0.0-20221031165847-c99f073a8326
@@ -27,6 +27,7 @@ WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
 
 import (
 	"encoding/binary"
+	"fmt"
 	"math/bits"
 	"reflect"
 	"unsafe"
@@ -181,14 +182,45 @@ var (
 		h ^= h >> 32
 		return uintptr(h)
 	}
+
+	// oword hasher for Key128 type, mixes both halves in the same way as two qword rounds
+	key128Hasher = func(key Key128) uintptr {
+		h := prime5 + 16
+
+		k1 := key.Hi * prime2
+		k1 = bits.RotateLeft64(k1, 31)
+		k1 *= prime1
+		h ^= k1
+		h = bits.RotateLeft64(h, 27)*prime1 + prime4
+
+		k1 = key.Lo * prime2
+		k1 = bits.RotateLeft64(k1, 31)
+		k1 *= prime1
+		h ^= k1
+		h = bits.RotateLeft64(h, 27)*prime1 + prime4
+
+		h ^= h >> 33
+		h *= prime2
+		h ^= h >> 29
+		h *= prime3
+		h ^= h >> 32
+		return uintptr(h)
+	}
 )
 
-func (m *Map[K, V]) setDefaultHasher() {
+// DefaultHasher returns the hash function used by default for maps with keys of type K
+// It can be wrapped or composed and then set back via SetHasher
+func DefaultHasher[K hashable]() func(K) uintptr {
+	switch any(*new(K)).(type) {
+	case Key128:
+		// custom Key128 oword hasher
+		return *(*func(K) uintptr)(unsafe.Pointer(&key128Hasher))
+	}
 	// default hash functions
 	switch reflect.TypeOf(*new(K)).Kind() {
 	case reflect.String:
 		// use default xxHash algorithm for key of any size for golang string data type
-		m.hasher = func(key K) uintptr {
+		return func(key K) uintptr {
 			sh := (*reflect.StringHeader)(unsafe.Pointer(&key))
 			b := unsafe.Slice((*byte)(unsafe.Pointer(sh.Data)), sh.Len)
 			n := sh.Len
@@ -245,38 +277,38 @@ func (m *Map[K, V]) setDefaultHasher() {
 		switch intSizeBytes {
 		case 2:
 			// word hasher
-			m.hasher = *(*func(K) uintptr)(unsafe.Pointer(&wordHasher))
+			return *(*func(K) uintptr)(unsafe.Pointer(&wordHasher))
 		case 4:
 			// dword hasher
-			m.hasher = *(*func(K) uintptr)(unsafe.Pointer(&dwordHasher))
+			return *(*func(K) uintptr)(unsafe.Pointer(&dwordHasher))
 		case 8:
 			// qword hasher
-			m.hasher = *(*func(K) uintptr)(unsafe.Pointer(&qwordHasher))
+			return *(*func(K) uintptr)(unsafe.Pointer(&qwordHasher))
 		}
 	case reflect.Int8, reflect.Uint8:
 		// byte hasher
-		m.hasher = *(*func(K) uintptr)(unsafe.Pointer(&byteHasher))
+		return *(*func(K) uintptr)(unsafe.Pointer(&byteHasher))
 	case reflect.Int16, reflect.Uint16:
 		// word hasher
-		m.hasher = *(*func(K) uintptr)(unsafe.Pointer(&wordHasher))
+		return *(*func(K) uintptr)(unsafe.Pointer(&wordHasher))
 	case reflect.Int32, reflect.Uint32:
 		// dword hasher
-		m.hasher = *(*func(K) uintptr)(unsafe.Pointer(&dwordHasher))
+		return *(*func(K) uintptr)(unsafe.Pointer(&dwordHasher))
 	case reflect.Float32:
 		// custom float32 dword hasher
-		m.hasher = *(*func(K) uintptr)(unsafe.Pointer(&float32Hasher))
+		return *(*func(K) uintptr)(unsafe.Pointer(&float32Hasher))
 	case reflect.Int64, reflect.Uint64:
 		// qword hasher
-		m.hasher = *(*func(K) uintptr)(unsafe.Pointer(&qwordHasher))
+		return *(*func(K) uintptr)(unsafe.Pointer(&qwordHasher))
 	case reflect.Float64:
 		// custom float64 qword hasher
-		m.hasher = *(*func(K) uintptr)(unsafe.Pointer(&float64Hasher))
+		return *(*func(K) uintptr)(unsafe.Pointer(&float64Hasher))
 	case reflect.Complex64:
 		// custom complex64 qword hasher
-		m.hasher = *(*func(K) uintptr)(unsafe.Pointer(&complex64Hasher))
+		return *(*func(K) uintptr)(unsafe.Pointer(&complex64Hasher))
 	case reflect.Complex128:
 		// oword hasher, key size -> 16 bytes
-		m.hasher = func(key K) uintptr {
+		return func(key K) uintptr {
 			b := *(*[owordSize]byte)(unsafe.Pointer(&key))
 			h := prime5 + 16
 
@@ -309,4 +341,104 @@ func (m *Map[K, V]) setDefaultHasher() {
 			return uintptr(h)
 		}
 	}
+	return nil
+}
+
+func (m *Map[K, V]) setDefaultHasher() {
+	m.storeHasher(DefaultHasher[K]())
+}
+
+// hasher hashes the key with the current hash function of the map
+func (m *Map[K, V]) hasher(key K) uintptr {
+	return (*m.hashFn.Load())(key)
+}
+
+// loadHasher returns the current hash function of the map
+func (m *Map[K, V]) loadHasher() func(K) uintptr {
+	if hs := m.hashFn.Load(); hs != nil {
+		return *hs
+	}
+	return nil
+}
+
+// storeHasher atomically replaces the hash function of the map
+// a lookup running concurrently hashes its key with either the old or the new function but never observes a torn one
+func (m *Map[K, V]) storeHasher(hs func(K) uintptr) {
+	m.hashFn.Store(&hs)
+}
+
+// requireHasher panics with a message naming the key type if the map has no hash function
+// this surfaces an unsupported key type at creation instead of as a nil function call on the first access
+func (m *Map[K, V]) requireHasher() {
+	if m.loadHasher() == nil {
+		panic(fmt.Sprintf("haxmap: no default hasher for key type %v, provide one via WithHasher", reflect.TypeOf(*new(K))))
+	}
+}
+
+// sum64 computes the xxHash of the given input keyed by the given seed
+func sum64(b []byte, seed uint64) uint64 {
+	n := len(b)
+	var h uint64
+
+	if n >= 32 {
+		v1 := seed + prime1v + prime2
+		v2 := seed + prime2
+		v3 := seed
+		v4 := seed - prime1v
+		for len(b) >= 32 {
+			v1 = round(v1, u64(b[0:8:len(b)]))
+			v2 = round(v2, u64(b[8:16:len(b)]))
+			v3 = round(v3, u64(b[16:24:len(b)]))
+			v4 = round(v4, u64(b[24:32:len(b)]))
+			b = b[32:len(b):len(b)]
+		}
+		h = rol1(v1) + rol7(v2) + rol12(v3) + rol18(v4)
+		h = mergeRound(h, v1)
+		h = mergeRound(h, v2)
+		h = mergeRound(h, v3)
+		h = mergeRound(h, v4)
+	} else {
+		h = seed + prime5
+	}
+
+	h += uint64(n)
+
+	i, end := 0, len(b)
+	for ; i+8 <= end; i += 8 {
+		k1 := round(0, u64(b[i:i+8:len(b)]))
+		h ^= k1
+		h = rol27(h)*prime1 + prime4
+	}
+	if i+4 <= end {
+		h ^= uint64(u32(b[i:i+4:len(b)])) * prime1
+		h = rol23(h)*prime2 + prime3
+		i += 4
+	}
+	for ; i < end; i++ {
+		h ^= uint64(b[i]) * prime5
+		h = rol11(h) * prime1
+	}
+
+	h ^= h >> 33
+	h *= prime2
+	h ^= h >> 29
+	h *= prime3
+	h ^= h >> 32
+
+	return h
+}
+
+// seededHasher returns a xxHash hash function for keys of type K keyed by the given seed
+// strings are hashed over their contents and all other types over their memory representation
+func seededHasher[K hashable](seed uint64) func(K) uintptr {
+	if reflect.TypeOf(*new(K)).Kind() == reflect.String {
+		return func(key K) uintptr {
+			sh := (*reflect.StringHeader)(unsafe.Pointer(&key))
+			return uintptr(sum64(unsafe.Slice((*byte)(unsafe.Pointer(sh.Data)), sh.Len), seed))
+		}
+	}
+	size := unsafe.Sizeof(*new(K))
+	return func(key K) uintptr {
+		return uintptr(sum64(unsafe.Slice((*byte)(unsafe.Pointer(&key)), size), seed))
+	}
 }
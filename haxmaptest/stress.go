@@ -0,0 +1,108 @@
+// Package haxmaptest provides helpers for testing code built on haxmap
+// and for reproducing concurrency bugs of the map with custom key and value types
+package haxmaptest
+
+import (
+	"errors"
+	"fmt"
+	"math/rand"
+	"runtime"
+	"sync"
+	"time"
+
+	"github.com/alphadose/haxmap"
+)
+
+// Options configures a StressConcurrent run
+type Options[K haxmap.Hashable, V any] struct {
+	// Key returns a random key, keys should be drawn from a small enough set for operations to collide
+	Key func(r *rand.Rand) K
+	// Value returns a random value, the zero value is used if nil
+	Value func(r *rand.Rand) V
+	// Duration is the total duration of the run, 1 second if 0
+	Duration time.Duration
+	// Rounds is the number of concurrent phases the duration is split into, each followed by a consistency check, 10 if 0
+	Rounds int
+	// Workers is the number of concurrent goroutines, GOMAXPROCS if 0
+	Workers int
+	// Seed seeds the random operations of the workers, the current time is used if 0
+	// A failing run can be repeated with the same seed although the interleaving of the workers differs between runs
+	Seed int64
+}
+
+// StressConcurrent runs randomized concurrent Set, Get, Del and Grow operations on the map and returns the first inconsistency found
+// The run is split into rounds, after every round all workers are stopped and the map is checked via Validate()
+// and by looking up every key found while iterating the map. It returns nil if no inconsistency was found
+func StressConcurrent[K haxmap.Hashable, V any](m *haxmap.Map[K, V], opts Options[K, V]) error {
+	if opts.Key == nil {
+		return errors.New("haxmaptest: Options.Key is required")
+	}
+	if opts.Duration <= 0 {
+		opts.Duration = time.Second
+	}
+	if opts.Rounds <= 0 {
+		opts.Rounds = 10
+	}
+	if opts.Workers <= 0 {
+		opts.Workers = runtime.GOMAXPROCS(0)
+	}
+	if opts.Seed == 0 {
+		opts.Seed = time.Now().UnixNano()
+	}
+
+	for round := 0; round < opts.Rounds; round++ {
+		var (
+			wg       sync.WaitGroup
+			deadline = time.Now().Add(opts.Duration / time.Duration(opts.Rounds))
+		)
+		for w := 0; w < opts.Workers; w++ {
+			wg.Add(1)
+			go func(r *rand.Rand) {
+				defer wg.Done()
+				for time.Now().Before(deadline) {
+					stressOnce(m, &opts, r)
+				}
+			}(rand.New(rand.NewSource(opts.Seed + int64(round*opts.Workers+w))))
+		}
+		wg.Wait()
+
+		if err := check(m); err != nil {
+			return fmt.Errorf("haxmaptest: round %d with seed %d: %w", round, opts.Seed, err)
+		}
+	}
+	return nil
+}
+
+// stressOnce performs a single random operation on the map
+func stressOnce[K haxmap.Hashable, V any](m *haxmap.Map[K, V], opts *Options[K, V], r *rand.Rand) {
+	key := opts.Key(r)
+	switch n := r.Intn(1000); {
+	case n < 400:
+		m.Get(key)
+	case n < 750:
+		var value V
+		if opts.Value != nil {
+			value = opts.Value(r)
+		}
+		m.Set(key, value)
+	case n < 999:
+		m.Del(key)
+	default:
+		// rebuild the index at about twice the current size which shrinks or grows it without unbounded growth
+		m.Grow(m.Len()*2 + 1)
+	}
+}
+
+// check verifies the invariants of a quiescent map
+func check[K haxmap.Hashable, V any](m *haxmap.Map[K, V]) (err error) {
+	if err = m.Validate(); err != nil {
+		return err
+	}
+	m.ForEach(func(key K, _ V) bool {
+		if _, ok := m.Get(key); !ok {
+			err = fmt.Errorf("key %v is reachable by iteration but not by lookup", key)
+		}
+		return err == nil
+	})
+	return err
+}
@@ -0,0 +1,27 @@
+package haxmaptest
+
+import (
+	"math/rand"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/alphadose/haxmap"
+)
+
+func TestStressConcurrent(t *testing.T) {
+	m := haxmap.New[string, int]()
+	err := StressConcurrent(m, Options[string, int]{
+		Key:      func(r *rand.Rand) string { return strconv.Itoa(r.Intn(1000)) },
+		Value:    func(r *rand.Rand) int { return r.Int() },
+		Duration: 200 * time.Millisecond,
+		Rounds:   4,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := StressConcurrent(m, Options[string, int]{}); err == nil {
+		t.Error("expected an error without a key generator")
+	}
+}
@@ -1,12 +1,6 @@
 package haxmap
 
-import "sync/atomic"
-
-// states denoting whether a node is deleted or not
-const (
-	notDeleted uint32 = iota
-	deleted
-)
+import "time"
 
 // Below implementation is a lock-free linked list based on https://www.cl.cam.ac.uk/research/srg/netos/papers/2001-caslists.pdf by Timothy L. Harris
 // Performance improvements suggested in https://arxiv.org/pdf/2010.15755.pdf were also added
@@ -15,37 +9,64 @@ const (
 func newListHead[K hashable, V any]() *element[K, V] {
 	e := &element[K, V]{keyHash: 0, key: *new(K)}
 	e.nextPtr.Store(nil)
-	e.value.Store(new(V))
+	e.value.Store(new(valueBox[V]))
 	return e
 }
 
+// the value of an element along with its version and expiry, a box is never modified once stored in an element
+// writers replace the whole box, so that a single pointer CAS publishes a value together with its version and expiry
+type valueBox[V any] struct {
+	value V
+	// incremented by every write replacing the value of the element
+	version uint64
+	// expiry time in unix nanoseconds, 0 if the value never expires
+	expiry int64
+}
+
 // a single node in the list
 type element[K hashable, V any] struct {
 	keyHash uintptr
 	key     K
 	// The next element in the list. If this pointer has the marked flag set it means THIS element, not the next one, is deleted.
-	nextPtr atomicPointer[element[K, V]]
-	value   atomicPointer[V]
-	deleted uint32
+	// Folding the deletion mark into the pointer ensures no element can be linked after an element which is being deleted
+	nextPtr markablePointer[element[K, V]]
+	value   atomicPointer[valueBox[V]]
 }
 
 // next returns the next element
 // this also deletes all marked elements while traversing the list
 func (self *element[K, V]) next() *element[K, V] {
 	for nextElement := self.nextPtr.Load(); nextElement != nil; {
+		if !nextElement.isDeleted() {
+			return nextElement
+		}
 		// if our next element is itself deleted (by the same criteria) then we will just replace
 		// it with its next() (which should be the first node behind it that isn't itself deleted) and then check again
-		if nextElement.isDeleted() {
-			self.nextPtr.CompareAndSwap(nextElement, nextElement.next()) // actual deletion happens here after nodes are marked deleted lazily
-			nextElement = self.nextPtr.Load()
+		successor := nextElement.next()
+		if self.nextPtr.CompareAndSwap(nextElement, successor) { // actual deletion happens here after nodes are marked deleted lazily
+			nextElement = successor
+		} else if self.isDeleted() {
+			// the link of a deleted element cannot be modified, hence skip over the deleted node without unlinking it
+			nextElement = successor
 		} else {
-			return nextElement
+			nextElement = self.nextPtr.Load()
 		}
 	}
 	return nil
 }
 
+// nextLive is like next() but also skips elements whose TTL has elapsed
+// expired elements linger in the list until overwritten or removed, traversals hide them just like lookups do
+func (self *element[K, V]) nextLive() *element[K, V] {
+	item := self.next()
+	for item != nil && item.isExpired() {
+		item = item.next()
+	}
+	return item
+}
+
 // addBefore inserts an element before the specified element
+// fails if the current element got marked for deletion as the CAS only succeeds on an unmarked pointer
 func (self *element[K, V]) addBefore(allocatedElement, before *element[K, V]) bool {
 	if self.next() != before {
 		return false
@@ -54,24 +75,35 @@ func (self *element[K, V]) addBefore(allocatedElement, before *element[K, V]) bo
 	return self.nextPtr.CompareAndSwap(before, allocatedElement)
 }
 
-// inject updates an existing value in the list if present or adds a new entry
-func (self *element[K, V]) inject(c uintptr, key K, value *V) (*element[K, V], bool) {
+// inject updates an existing value in the list if present or adds a new entry, the value expires at `expiry` (0 for never)
+// if overwrite is false then the value of an existing unexpired entry is left untouched
+// returns the entry for the key, whether it was newly added and whether the given value was stored,
+// or no entry if the caller has to retry
+func (self *element[K, V]) inject(c uintptr, key K, value *V, expiry int64, overwrite bool) (*element[K, V], bool, bool) {
 	var (
 		alloc             *element[K, V]
 		left, curr, right = self.search(c, key)
 	)
 	if curr != nil {
-		curr.value.Store(value)
-		return curr, false
+		if !overwrite && !curr.isExpired() {
+			return curr, false, false
+		}
+		curr.replaceValue(value, expiry, false)
+		if curr.isDeleted() {
+			// the element got deleted meanwhile, e.g. by Drain() which might have read its value before the store,
+			// hence the caller has to retry on the list so that the write cannot get lost
+			return nil, false, false
+		}
+		return curr, false, true
 	}
 	if left != nil {
 		alloc = &element[K, V]{keyHash: c, key: key}
-		alloc.value.Store(value)
+		alloc.value.Store(&valueBox[V]{value: *value, expiry: expiry})
 		if left.addBefore(alloc, right) {
-			return alloc, true
+			return alloc, true, true
 		}
 	}
-	return nil, false
+	return nil, false, false
 }
 
 // search for an element in the list and return left_element, searched_element and right_element respectively
@@ -102,10 +134,60 @@ func (self *element[K, V]) search(c uintptr, key K) (*element[K, V], *element[K,
 // the node will be removed in the next iteration via `element.next()`
 // CAS ensures each node can be marked for deletion exactly once
 func (self *element[K, V]) remove() bool {
-	return atomic.CompareAndSwapUint32(&self.deleted, notDeleted, deleted)
+	return self.nextPtr.Mark()
 }
 
 // if current element is deleted
 func (self *element[K, V]) isDeleted() bool {
-	return atomic.LoadUint32(&self.deleted) == deleted
+	return self.nextPtr.IsMarked()
+}
+
+// if current element has expired
+func (self *element[K, V]) isExpired() bool {
+	return self.value.Load().isExpired()
+}
+
+// if the value has expired
+func (self *valueBox[V]) isExpired() bool {
+	return self.expiry != 0 && time.Now().UnixNano() > self.expiry
+}
+
+// refreshExpiry replaces the expiry of the element unless it already expired at time `now`
+// the check and the update form a single CAS so that an element which expired in between cannot be revived,
+// the version stays the same as the value is left untouched. returns the box holding the new expiry if refreshed
+func (self *element[K, V]) refreshExpiry(now, expiry int64) (*valueBox[V], bool) {
+	for attempt := uint32(1); ; attempt++ {
+		current := self.value.Load()
+		if current.expiry != 0 && now > current.expiry {
+			return nil, false
+		}
+		box := &valueBox[V]{value: current.value, version: current.version, expiry: expiry}
+		if self.value.CompareAndSwap(current, box) {
+			return box, true
+		}
+		backoff(attempt)
+	}
+}
+
+// replaceValue replaces the value, moving on to the next version, and returns the box holding the previous value
+// the new value expires at `expiry` (0 for never) unless keepExpiry is set, in which case the current expiry is retained
+func (self *element[K, V]) replaceValue(value *V, expiry int64, keepExpiry bool) *valueBox[V] {
+	box := &valueBox[V]{value: *value, expiry: expiry}
+	for attempt := uint32(1); ; attempt++ {
+		current := self.value.Load()
+		box.version = current.version + 1
+		if keepExpiry {
+			box.expiry = current.expiry
+		}
+		if self.value.CompareAndSwap(current, box) {
+			return current
+		}
+		backoff(attempt)
+	}
+}
+
+// compareAndSwapValue replaces the value if the box of the element is still `old`, moving on to the next version
+// the new value retains the expiry of the old one
+func (self *element[K, V]) compareAndSwapValue(old *valueBox[V], new *V) bool {
+	return self.value.CompareAndSwap(old, &valueBox[V]{value: *new, version: old.version + 1, expiry: old.expiry})
 }
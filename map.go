@@ -1,25 +1,46 @@
 package haxmap
 
 import (
+	"bufio"
+	"bytes"
+	"encoding"
+	"encoding/gob"
 	"encoding/json"
+	"fmt"
+	"io"
+	"math"
+	"math/bits"
 	"reflect"
+	"runtime"
 	"sort"
 	"strconv"
+	"strings"
+	"sync"
 	"sync/atomic"
+	"time"
 	"unsafe"
 
 	"golang.org/x/exp/constraints"
 )
 
 const (
+	// defaultCASBackoff is the default number of failed attempts of a contended retry loop before it starts yielding
+	defaultCASBackoff = 4
+
 	// defaultSize is the default size for a zero allocated map
 	defaultSize = 8
 
-	// maxFillRate is the maximum fill rate for the slice before a resize will happen
-	maxFillRate = 50
+	// defaultMaxFillRate is the default maximum fill rate for the slice before a resize will happen
+	defaultMaxFillRate = 50
+
+	// defaultGrowthFactor is the default factor by which the slice grows on a resize
+	defaultGrowthFactor = 2.0
 
 	// intSizeBytes is the size in byte of an int or uint value
 	intSizeBytes = strconv.IntSize >> 3
+
+	// maxIndexSize is the largest power of 2 representable by uintptr, all index sizes are clamped to it
+	maxIndexSize = 1 << (strconv.IntSize - 1)
 )
 
 // indicates resizing operation status enums
@@ -30,7 +51,23 @@ const (
 
 type (
 	hashable interface {
-		constraints.Integer | constraints.Float | constraints.Complex | ~string | uintptr | ~unsafe.Pointer
+		constraints.Integer | constraints.Float | constraints.Complex | ~string | uintptr | ~unsafe.Pointer | Key128
+	}
+
+	// Hashable is the constraint on the key types of a map, exported for generic code built on top of this package
+	Hashable interface {
+		hashable
+	}
+
+	// Pair is a key-value pair of the map
+	Pair[K hashable, V any] struct {
+		Key   K
+		Value V
+	}
+
+	// Key128 is a 128-bit key such as a UUID or a 128-bit hash, compared directly without converting to a string
+	Key128 struct {
+		Hi, Lo uint64
 	}
 
 	// metadata of the hashmap
@@ -38,6 +75,7 @@ type (
 		keyshifts uintptr        //  array_size - log2(array_size)
 		count     atomicUintptr  // number of filled items
 		data      unsafe.Pointer // pointer to array of map indexes
+		listHead  *element[K, V] // head of the list, used as fallback when no index precedes a hash
 
 		// use a struct element with generic params to enable monomorphization (generic code copy-paste) for the parent metadata struct by golang compiler leading to best performance (truly hax)
 		// else in other cases the generic params will be unnecessarily passed as function parameters everytime instead of monomorphization leading to slower performance
@@ -46,31 +84,100 @@ type (
 
 	// Map implements the concurrent hashmap
 	Map[K hashable, V any] struct {
-		listHead    *element[K, V] // Harris lock-free list of elements in ascending order of hash
-		hasher      func(K) uintptr
-		metadata    atomicPointer[metadata[K, V]] // atomic.Pointer for safe access even during resizing
+		// bits of the float64 factor by which the index grows on a resize
+		// kept as the first field to guarantee 64-bit alignment for atomic access on 32-bit platforms
+		growthBits atomicUint64
+
+		listHead    *element[K, V]                 // Harris lock-free list of elements in ascending order of hash
+		hashFn      atomicPointer[func(K) uintptr] // stored atomically so that SetHasher() cannot race with concurrent hashing
+		metadata    atomicPointer[metadata[K, V]]  // atomic.Pointer for safe access even during resizing
 		resizing    atomicUint32
 		numItems    atomicUintptr
 		defaultSize uintptr
+		maxFillRate atomicUintptr         // maximum fill rate percentage of the index before a resize will happen
+		maxItems    uintptr               // upper bound on the number of items, 0 for unbounded maps
+		onEvict     func(K, V)            // called with every pair evicted from a bounded map
+		order       *insertionOrder[K, V] // elements in order of insertion, nil unless enabled at creation
+		views       *readViews[K, V]      // open read views, nil unless enabled at creation
+		fixedSize   atomicUint32          // 1 if automatic resizing is disabled via SetAutoGrow
+		resizes     atomicUintptr         // number of completed resizes
+		expiring    atomicUint32          // 1 once an entry got an expiry, as expired entries are counted until removed
+
+		onResize atomicPointer[func(oldSize, newSize uintptr)] // called after every completed resize, nil if not registered
+		batches  sync.Pool                                     // reusable *batch buffers of ForEachBatch
+		flightMu sync.Mutex                                    // guards flights
+		flights  map[K]*flight[V]                              // in-flight computations of GetOrComputeSingleFlight
+		metrics  atomicPointer[metrics]                        // lookup counters, nil unless enabled via EnableMetrics
+		writeLog atomicPointer[writeLog[K]]                    // recent writes, nil unless enabled via EnableWriteLog
+	}
+
+	// counters of lookups via Get and of colliding insertions
+	metrics struct {
+		hits, misses, collisions atomicUint64
+	}
+
+	// a value computation shared by concurrent GetOrComputeSingleFlight calls for the same key
+	flight[V any] struct {
+		done  chan struct{} // closed once the computation finished
+		value V
+		ok    bool // false if the computation panicked
+	}
+
+	// buffers holding the pairs of a single batch of ForEachBatch
+	batch[K hashable, V any] struct {
+		keys   []K
+		values []V
 	}
 
-	// used in deletion of map elements
-	deletionRequest[K hashable] struct {
+	// key along with its hash, used in bulk operations on map elements
+	hashedKey[K hashable] struct {
 		keyHash uintptr
 		key     K
 	}
 )
 
 // New returns a new HashMap instance with an optional specific initialization size
+// The size is the number of index slots and gets rounded up to the next power of 2, see Capacity()
 func New[K hashable, V any](size ...uintptr) *Map[K, V] {
-	m := &Map[K, V]{listHead: newListHead[K, V]()}
-	m.numItems.Store(0)
-	m.defaultSize = defaultSize
-	if len(size) > 0 && size[0] > 0 {
-		m.defaultSize = size[0]
+	if len(size) > 0 {
+		return NewWithOptions(WithInitialSize[K, V](size[0]))
+	}
+	return NewWithOptions[K, V]()
+}
+
+// NewBounded returns a new HashMap instance holding at most `maxItems` items, pre-allocated to never resize
+// When a new key gets inserted into a full map then the entry with the smallest key hash (other than the new one)
+// is evicted and `onEvict` (if not nil) is called with the evicted pair
+// Each insertion which takes the item counter above `maxItems` evicts exactly one entry
+// hence concurrent insertions at the boundary never evict more entries than they added
+// It panics if maxItems is 0, use New for an unbounded map
+func NewBounded[K hashable, V any](maxItems uintptr, onEvict func(K, V)) *Map[K, V] {
+	if maxItems == 0 {
+		panic("haxmap: NewBounded called with a bound of 0 items")
+	}
+	m := New[K, V](maxItems * 100 / defaultMaxFillRate)
+	m.maxItems = maxItems
+	m.onEvict = onEvict
+	return m
+}
+
+// NewLazy returns a new HashMap instance which defers allocating its index until the first insertion
+// This saves the up-front allocation for applications creating many maps which mostly stay empty
+// Lookups on a map without an index return absent immediately, the first insertion allocates the default sized index
+// under the resizing flag so that concurrent first insertions allocate it only once
+func NewLazy[K hashable, V any]() *Map[K, V] {
+	return NewWithOptions(func(cfg *config[K, V]) {
+		cfg.lazy = true
+	})
+}
+
+// FromMap returns a new HashMap instance containing all the key-value pairs of the given map
+// The map is pre-allocated to hold all the pairs under the default fill rate without resizing during population
+func FromMap[K hashable, V any](src map[K]V) *Map[K, V] {
+	m := New[K, V](uintptr(len(src)) * 100 / defaultMaxFillRate)
+	for key, value := range src {
+		m.Set(key, value)
 	}
-	m.allocate(m.defaultSize)
-	m.setDefaultHasher()
 	return m
 }
 
@@ -91,15 +198,14 @@ func (m *Map[K, V]) Del(keys ...K) {
 		}
 		for ; existing != nil && existing.keyHash <= h; existing = existing.next() {
 			if existing.key == keys[0] {
-				if existing.remove() { // mark node for lazy removal on next pass
-					m.removeItemFromIndex(existing) // remove node from map index
-				}
+				// mark node for lazy removal on next pass and remove it from map index
+				m.removeItemFromIndex(existing, m.removeElement(existing))
 				return
 			}
 		}
 	default: // delete multiple entries
 		var (
-			delQ = make([]deletionRequest[K], size)
+			delQ = make([]hashedKey[K], size)
 			iter = 0
 		)
 		for idx := 0; idx < size; idx++ {
@@ -119,9 +225,8 @@ func (m *Map[K, V]) Del(keys ...K) {
 
 		for elem != nil && iter < size {
 			if elem.keyHash == delQ[iter].keyHash && elem.key == delQ[iter].key {
-				if elem.remove() { // mark node for lazy removal on next pass
-					m.removeItemFromIndex(elem) // remove node from map index
-				}
+				// mark node for lazy removal on next pass and remove it from map index
+				m.removeItemFromIndex(elem, m.removeElement(elem))
 				iter++
 				elem = elem.next()
 			} else if elem.keyHash > delQ[iter].keyHash {
@@ -136,11 +241,15 @@ func (m *Map[K, V]) Del(keys ...K) {
 // Get retrieves an element from the map
 // returns `false“ if element is absent
 func (m *Map[K, V]) Get(key K) (value V, ok bool) {
+	if mt := m.metrics.Load(); mt != nil {
+		return m.getInstrumented(key, mt)
+	}
 	h := m.hasher(key)
 	// inline search
 	for elem := m.metadata.Load().indexElement(h); elem != nil && elem.keyHash <= h; elem = elem.nextPtr.Load() {
 		if elem.key == key {
-			value, ok = *elem.value.Load(), !elem.isDeleted()
+			box := elem.value.Load()
+			value, ok = box.value, !elem.isDeleted() && !box.isExpired()
 			return
 		}
 	}
@@ -148,131 +257,497 @@ func (m *Map[K, V]) Get(key K) (value V, ok bool) {
 	return
 }
 
+// GetConsistent is similar to Get but if a resize is in progress it first waits for the resize to finish
+// so that the lookup goes through the new index, giving read-your-writes consistency right after a concurrent Grow()
+// The wait is bounded to 10ms, if the resize is still in progress afterwards then the list is scanned from its head
+// which finds every linked element regardless of the state of the index at the cost of a full traversal
+func (m *Map[K, V]) GetConsistent(key K) (value V, ok bool) {
+	const maxWait = 10 * time.Millisecond
+	for start := time.Now(); m.resizing.Load() == resizingInProgress; {
+		if time.Since(start) > maxWait {
+			h := m.hasher(key)
+			for elem := m.listHead.next(); elem != nil && elem.keyHash <= h; elem = elem.next() {
+				if elem.keyHash == h && elem.key == key {
+					box := elem.value.Load()
+					return box.value, !box.isExpired()
+				}
+			}
+			return
+		}
+		runtime.Gosched()
+	}
+	return m.Get(key)
+}
+
+// GetWithBucket is similar to Get but additionally returns the index slot the key resolves to
+// The slot is computed for the current index and changes when the map is resized
+func (m *Map[K, V]) GetWithBucket(key K) (value V, bucket uintptr, ok bool) {
+	var (
+		h    = m.hasher(key)
+		data = m.metadata.Load()
+	)
+	if data != nil {
+		bucket = h >> data.keyshifts
+	}
+	for elem := data.indexElement(h); elem != nil && elem.keyHash <= h; elem = elem.nextPtr.Load() {
+		if elem.key == key {
+			box := elem.value.Load()
+			value, ok = box.value, !elem.isDeleted() && !box.isExpired()
+			return
+		}
+	}
+	return
+}
+
+// getInstrumented is Get with lookup counters, kept separate so that Get pays only a single load if metrics are disabled
+func (m *Map[K, V]) getInstrumented(key K, mt *metrics) (value V, ok bool) {
+	h := m.hasher(key)
+	for elem := m.metadata.Load().indexElement(h); elem != nil && elem.keyHash <= h; elem = elem.nextPtr.Load() {
+		if elem.key == key {
+			box := elem.value.Load()
+			value, ok = box.value, !elem.isDeleted() && !box.isExpired()
+			break
+		}
+	}
+	if ok {
+		mt.hits.Add(1)
+	} else {
+		mt.misses.Add(1)
+	}
+	return
+}
+
+// GetOrDefault retrieves an element from the map under given hash key, returning `def` if the key is absent
+func (m *Map[K, V]) GetOrDefault(key K, def V) V {
+	h := m.hasher(key)
+	// inline search
+	for elem := m.metadata.Load().indexElement(h); elem != nil && elem.keyHash <= h; elem = elem.nextPtr.Load() {
+		if elem.key == key {
+			if box := elem.value.Load(); !elem.isDeleted() && !box.isExpired() {
+				return box.value
+			}
+			return def
+		}
+	}
+	return def
+}
+
+// GetAll retrieves multiple elements from the map, absent keys are omitted from the returned map
+// The keys are sorted by their hashes and the list is walked only once
+// hence it is more efficient than getting keys one by one for large batches
+func (m *Map[K, V]) GetAll(keys ...K) map[K]V {
+	result := make(map[K]V, len(keys))
+	if len(keys) == 0 {
+		return result
+	}
+	getQ := make([]hashedKey[K], len(keys))
+	for idx := range keys {
+		getQ[idx].keyHash, getQ[idx].key = m.hasher(keys[idx]), keys[idx]
+	}
+
+	// sort in ascending order of keyhash
+	sort.Slice(getQ, func(i, j int) bool {
+		return getQ[i].keyHash < getQ[j].keyHash
+	})
+
+	elem := m.metadata.Load().indexElement(getQ[0].keyHash)
+	if elem == nil || elem.keyHash > getQ[0].keyHash {
+		elem = m.listHead.next()
+	}
+	for _, req := range getQ {
+		for elem != nil && elem.keyHash < req.keyHash {
+			elem = elem.next()
+		}
+		// scan all elements with the same hash without consuming them as the next key might collide too
+		for item := elem; item != nil && item.keyHash == req.keyHash; item = item.next() {
+			if item.key == req.key {
+				if box := item.value.Load(); !box.isExpired() {
+					result[req.key] = box.value
+				}
+				break
+			}
+		}
+	}
+	return result
+}
+
+// ContainsAll reports the presence of every key, element i of the result is true if keys[i] is present in the map
+// The keys are sorted by their hashes and the list is walked only once
+// hence it is more efficient than looking up keys one by one for large batches
+func (m *Map[K, V]) ContainsAll(keys ...K) []bool {
+	found := make([]bool, len(keys))
+	if len(keys) == 0 {
+		return found
+	}
+	order := make([]int, len(keys))
+	hashes := make([]uintptr, len(keys))
+	for i, key := range keys {
+		order[i], hashes[i] = i, m.hasher(key)
+	}
+
+	// sort in ascending order of keyhash
+	sort.Slice(order, func(i, j int) bool {
+		return hashes[order[i]] < hashes[order[j]]
+	})
+
+	first := hashes[order[0]]
+	elem := m.metadata.Load().indexElement(first)
+	if elem == nil || elem.keyHash > first {
+		elem = m.listHead.next()
+	}
+	for _, i := range order {
+		for elem != nil && elem.keyHash < hashes[i] {
+			elem = elem.next()
+		}
+		// scan all elements with the same hash without consuming them as the next key might collide too
+		for item := elem; item != nil && item.keyHash == hashes[i]; item = item.next() {
+			if item.key == keys[i] {
+				found[i] = !item.isExpired()
+				break
+			}
+		}
+	}
+	return found
+}
+
+// ReplaceAll replaces the values of all keys of `entries` which are present in the map
+// Absent keys are inserted if `insertMissing` is true, otherwise they are ignored
+// The values are not replaced atomically across keys as every element holds its own value box,
+// instead all present elements are located first in a single pass over the list and then their values are stored in a tight loop
+// which keeps the window in which a reader can observe a mix of old and new values as short as possible
+// Missing keys are inserted only after all present keys were updated
+func (m *Map[K, V]) ReplaceAll(entries map[K]V, insertMissing bool) {
+	if len(entries) == 0 {
+		return
+	}
+	replaceQ := make([]hashedKey[K], 0, len(entries))
+	for key := range entries {
+		replaceQ = append(replaceQ, hashedKey[K]{keyHash: m.hasher(key), key: key})
+	}
+
+	// sort in ascending order of keyhash
+	sort.Slice(replaceQ, func(i, j int) bool {
+		return replaceQ[i].keyHash < replaceQ[j].keyHash
+	})
+
+	var (
+		found   = make([]*element[K, V], 0, len(entries))
+		values  = make([]*V, 0, len(entries))
+		missing []K
+	)
+	elem := m.metadata.Load().indexElement(replaceQ[0].keyHash)
+	if elem == nil || elem.keyHash > replaceQ[0].keyHash {
+		elem = m.listHead.next()
+	}
+	for _, req := range replaceQ {
+		for elem != nil && elem.keyHash < req.keyHash {
+			elem = elem.next()
+		}
+		present := false
+		// scan all elements with the same hash without consuming them as the next key might collide too
+		for item := elem; item != nil && item.keyHash == req.keyHash; item = item.next() {
+			if item.key == req.key {
+				if present = !item.isExpired(); present {
+					value := entries[req.key]
+					found, values = append(found, item), append(values, &value)
+				}
+				break
+			}
+		}
+		if !present && insertMissing {
+			missing = append(missing, req.key)
+		}
+	}
+
+	for i, item := range found {
+		m.beginWrite()
+		item.replaceValue(values[i], 0, true)
+		m.endWrite()
+		// a value stored into an element deleted meanwhile might be lost, see Drain(), hence it is inserted again
+		if item.isDeleted() && insertMissing {
+			missing = append(missing, item.key)
+		}
+	}
+	for _, key := range missing {
+		value := entries[key]
+		m.set(key, &value, 0, true)
+	}
+}
+
 // Set tries to update an element if key is present else it inserts a new element
 // If a resizing operation is happening concurrently while calling Set()
-// then the item might show up in the map only after the resize operation is finished
+// then Set() waits for it to finish and indexes the item in the new metadata before returning
+// Values are stored by assignment, so values of reference types like slices or maps keep sharing their backing storage
+// with the caller and later mutations by the caller are visible through the map, see SetCopy for byte slices
 func (m *Map[K, V]) Set(key K, value V) {
+	m.set(key, &value, 0, true)
+}
+
+// SetAndReport is similar to Set but reports whether the value of an already present key got overwritten
+// An entry whose TTL elapsed but which was not removed yet counts as present
+func (m *Map[K, V]) SetAndReport(key K, value V) (overwritten bool) {
+	_, created, _ := m.set(key, &value, 0, true)
+	return !created
+}
+
+// SetReportAlloc is similar to Set but reports whether a new list node was allocated for the key
+// This is the case if the key was absent, whereas the value of a present key is updated in place in its existing node,
+// also if its TTL elapsed without it being removed yet. Every call allocates a box for the value regardless
+func (m *Map[K, V]) SetReportAlloc(key K, value V) (allocated bool) {
+	_, allocated, _ = m.set(key, &value, 0, true)
+	return
+}
+
+// SetX is similar to Set but additionally reports whether the key was newly inserted
+// and whether the insertion crossed the fill rate threshold and resized the map
+// resized is only true for the call which performed the resize, this lets bulk loaders track the resize frequency or back off
+func (m *Map[K, V]) SetX(key K, value V) (created, resized bool) {
+	_, created, _, resized = m.insert(key, &value, 0, true)
+	return
+}
+
+// SetSlices sets the value of every key in `keys` to the value at the same position in `values`
+// The pairs are inserted in ascending order of key hashes which walks the list and the index sequentially
+// hence it is more cache-friendly than setting the pairs one by one for large columnar loads
+// If a key occurs more than once then the last corresponding value is set, it panics if the lengths of the slices differ
+func (m *Map[K, V]) SetSlices(keys []K, values []V) {
+	if len(keys) != len(values) {
+		panic(fmt.Sprintf("haxmap: SetSlices called with %d keys but %d values", len(keys), len(values)))
+	}
+	order := make([]int, len(keys))
+	hashes := make([]uintptr, len(keys))
+	for i, key := range keys {
+		order[i], hashes[i] = i, m.hasher(key)
+	}
+	sort.SliceStable(order, func(i, j int) bool {
+		return hashes[order[i]] < hashes[order[j]]
+	})
+
+	m.Reserve(uintptr(len(keys)))
+	for _, i := range order {
+		value := values[i] // copied as the map must not alias the caller's slice
+		m.set(keys[i], &value, 0, true)
+	}
+}
+
+// TrySet tries to set the value under the specified key in a single attempt without retrying
+// It returns false without modifying the map if a resize is in progress or if the insertion lost a race against a concurrent writer
+// letting the caller decide whether to retry or back off
+// It never waits for a resize and never grows the map itself, even if the insertion crossed the fill rate,
+// the growth is left to the next insertion of a new key via Set() or a similar method
+func (m *Map[K, V]) TrySet(key K, value V) bool {
+	if m.resizing.Load() == resizingInProgress {
+		return false
+	}
+	data := m.metadata.Load()
+	if data == nil {
+		// a lazy map without an index, allocating it is not a resize and fails if someone else is already at it
+		m.allocate(m.defaultSize)
+		if data = m.metadata.Load(); data == nil {
+			return false
+		}
+	}
 	var (
 		h        = m.hasher(key)
-		valPtr   = &value
-		alloc    *element[K, V]
-		created  = false
-		data     = m.metadata.Load()
 		existing = data.indexElement(h)
 	)
-
 	if existing == nil || existing.keyHash > h {
 		existing = m.listHead
 	}
-	if alloc, created = existing.inject(h, key, valPtr); alloc != nil {
-		if created {
-			m.numItems.Add(1)
-		}
-	} else {
-		for existing = m.listHead; alloc == nil; alloc, created = existing.inject(h, key, valPtr) {
-		}
-		if created {
-			m.numItems.Add(1)
-		}
+	m.beginWrite()
+	alloc, created, _ := existing.inject(h, key, &value, 0, true)
+	m.endWrite()
+	if alloc == nil {
+		return false
 	}
+	if mt := m.metrics.Load(); mt != nil {
+		m.countCollision(mt, existing, alloc)
+	}
+	m.accountSet(alloc, created)
+	// unlike indexItem() the item is indexed only once, if a resize started meanwhile then the new index might miss it
+	// which only makes lookups of the key walk the list from an earlier element until the index gets rebuilt
+	data.addItemToIndex(alloc)
+	return true
+}
 
-	count := data.addItemToIndex(alloc)
-	if resizeNeeded(uintptr(len(data.index)), count) && m.resizing.CompareAndSwap(notResizing, resizingInProgress) {
-		m.grow(0) // double in size
+// SetWithTTL is similar to Set but the entry expires after the given duration
+// Expired entries are treated as absent by all lookups and skipped by all traversals and copies like Clone() or Split()
+// but keep occupying the map, and counting towards Len(), until overwritten, deleted or swept by RemoveExpired()
+// A subsequent Set() of the same key removes the expiry
+func (m *Map[K, V]) SetWithTTL(key K, value V, ttl time.Duration) {
+	m.set(key, &value, time.Now().Add(ttl).UnixNano(), true)
+}
+
+// GetAndRefresh retrieves an element from the map and extends its expiry to `ttl` from now, for sliding expiration caches
+// An entry without an expiry gets one, expired entries are treated as absent and not revived
+// returns `false` if element is absent
+func (m *Map[K, V]) GetAndRefresh(key K, ttl time.Duration) (value V, ok bool) {
+	h := m.hasher(key)
+	for elem := m.metadata.Load().indexElement(h); elem != nil && elem.keyHash <= h; elem = elem.nextPtr.Load() {
+		if elem.key == key {
+			if elem.isDeleted() {
+				return
+			}
+			now := time.Now()
+			m.markExpiring()
+			m.beginWrite()
+			box, refreshed := elem.refreshExpiry(now.UnixNano(), now.Add(ttl).UnixNano())
+			m.endWrite()
+			if refreshed {
+				value, ok = box.value, true
+			}
+			return
+		}
 	}
+	return
 }
 
 // GetOrSet returns the existing value for the key if present
 // Otherwise, it stores and returns the given value
 // The loaded result is true if the value was loaded, false if stored
 func (m *Map[K, V]) GetOrSet(key K, value V) (actual V, loaded bool) {
-	var (
-		h        = m.hasher(key)
-		data     = m.metadata.Load()
-		existing = data.indexElement(h)
-	)
+	h := m.hasher(key)
 	// try to get the element if present
-	for elem := existing; elem != nil && elem.keyHash <= h; elem = elem.nextPtr.Load() {
+	for elem := m.metadata.Load().indexElement(h); elem != nil && elem.keyHash <= h; elem = elem.nextPtr.Load() {
 		if elem.key == key && !elem.isDeleted() {
-			actual, loaded = *elem.value.Load(), true
-			return
+			if box := elem.value.Load(); !box.isExpired() {
+				actual, loaded = box.value, true
+				return
+			}
 		}
 	}
 	// Get() failed because element is absent
-	// store the value given by user
+	// store a copy of the value given by user unless a concurrent writer inserted the key in the meantime
+	// the address is only taken of the copy so that the parameter does not escape to the heap on the hit path
+	valPtr := new(V)
+	*valPtr = value
+	if alloc, _, stored := m.set(key, valPtr, 0, false); !stored {
+		return alloc.value.Load().value, true
+	}
 	actual, loaded = value, false
+	return
+}
 
-	var (
-		alloc   *element[K, V]
-		created = false
-		valPtr  = &value
-	)
-	if existing == nil || existing.keyHash > h {
-		existing = m.listHead
-	}
-	if alloc, created = existing.inject(h, key, valPtr); alloc != nil {
-		if created {
-			m.numItems.Add(1)
-		}
-	} else {
-		for existing = m.listHead; alloc == nil; alloc, created = existing.inject(h, key, valPtr) {
-		}
-		if created {
-			m.numItems.Add(1)
+// GetOrSetRef is similar to GetOrSet but returns a pointer to the value held by the map
+// It allows in-place mutation of the value without setting it again
+// Every write to a key atomically replaces the box holding the value (see valueBox), hence the returned pointer
+// is only stable until the next write to that key after which it refers to a detached copy
+// Mutations through the pointer are not synchronized, so it is only safe for single-writer-per-key patterns
+func (m *Map[K, V]) GetOrSetRef(key K, value V) (actual *V, loaded bool) {
+	h := m.hasher(key)
+	// try to get the element if present
+	for elem := m.metadata.Load().indexElement(h); elem != nil && elem.keyHash <= h; elem = elem.nextPtr.Load() {
+		if elem.key == key && !elem.isDeleted() {
+			if box := elem.value.Load(); !box.isExpired() {
+				actual, loaded = &box.value, true
+				return
+			}
 		}
 	}
-
-	count := data.addItemToIndex(alloc)
-	if resizeNeeded(uintptr(len(data.index)), count) && m.resizing.CompareAndSwap(notResizing, resizingInProgress) {
-		m.grow(0) // double in size
-	}
-	return
+	// Get() failed because element is absent
+	// store the value given by user unless a concurrent writer inserted the key in the meantime
+	alloc, _, stored := m.set(key, &value, 0, false)
+	return &alloc.value.Load().value, !stored
 }
 
 // GetOrCompute is similar to GetOrSet but the value to be set is obtained from a constructor
-// the value constructor is called only once
+// the value constructor is called only once per call, but concurrent calls for the same absent key may each call it
+// with all but the stored value being discarded, see GetOrComputeSingleFlight() and GetOrCreateSubmap() to avoid that
 func (m *Map[K, V]) GetOrCompute(key K, valueFn func() V) (actual V, loaded bool) {
-	var (
-		h        = m.hasher(key)
-		data     = m.metadata.Load()
-		existing = data.indexElement(h)
-	)
+	h := m.hasher(key)
 	// try to get the element if present
-	for elem := existing; elem != nil && elem.keyHash <= h; elem = elem.nextPtr.Load() {
+	for elem := m.metadata.Load().indexElement(h); elem != nil && elem.keyHash <= h; elem = elem.nextPtr.Load() {
 		if elem.key == key && !elem.isDeleted() {
-			actual, loaded = *elem.value.Load(), true
-			return
+			if box := elem.value.Load(); !box.isExpired() {
+				actual, loaded = box.value, true
+				return
+			}
 		}
 	}
 	// Get() failed because element is absent
-	// compute the value from the constructor and store it
+	// compute the value from the constructor and store it unless a concurrent writer inserted the key in the meantime
 	value := valueFn()
+	if alloc, _, stored := m.set(key, &value, 0, false); !stored {
+		return alloc.value.Load().value, true
+	}
 	actual, loaded = value, false
+	return
+}
 
-	var (
-		alloc   *element[K, V]
-		created = false
-		valPtr  = &value
-	)
-	if existing == nil || existing.keyHash > h {
-		existing = m.listHead
-	}
-	if alloc, created = existing.inject(h, key, valPtr); alloc != nil {
-		if created {
-			m.numItems.Add(1)
+// GetOrCreateSubmap returns the submap stored under the key of a map of maps, creating and storing an empty one if absent
+// Concurrent calls for the same absent key construct a single submap and all return it, so no writes get lost to a discarded submap
+func GetOrCreateSubmap[K, K2 hashable, V2 any](m *Map[K, *Map[K2, V2]], key K) *Map[K2, V2] {
+	sub, _ := m.GetOrComputeSingleFlight(key, func() *Map[K2, V2] {
+		return New[K2, V2]()
+	})
+	return sub
+}
+
+// GetOrComputeSingleFlight is similar to GetOrCompute but concurrent calls for the same absent key are deduplicated
+// The first caller computes the value while the others block until it is stored and then return it with `loaded` as true
+// The in-flight entry is removed right after the value is stored, so later calls find the value in the map instead
+// If the constructor panics then the waiting callers retry the computation themselves
+func (m *Map[K, V]) GetOrComputeSingleFlight(key K, valueFn func() V) (actual V, loaded bool) {
+	for {
+		if actual, loaded = m.Get(key); loaded {
+			return
 		}
-	} else {
-		for existing = m.listHead; alloc == nil; alloc, created = existing.inject(h, key, valPtr) {
+		m.flightMu.Lock()
+		if f, ok := m.flights[key]; ok {
+			m.flightMu.Unlock()
+			if <-f.done; f.ok {
+				return f.value, true
+			}
+			continue
+		}
+		// the value might have been stored by a flight which completed after the lookup above
+		if actual, loaded = m.Get(key); loaded {
+			m.flightMu.Unlock()
+			return
 		}
-		if created {
-			m.numItems.Add(1)
+		f := &flight[V]{done: make(chan struct{})}
+		if m.flights == nil {
+			m.flights = make(map[K]*flight[V])
 		}
+		m.flights[key] = f
+		m.flightMu.Unlock()
+
+		defer func() {
+			m.flightMu.Lock()
+			delete(m.flights, key)
+			m.flightMu.Unlock()
+			close(f.done)
+		}()
+		f.value, loaded = m.GetOrCompute(key, valueFn)
+		f.ok = true
+		return f.value, loaded
 	}
+}
 
-	count := data.addItemToIndex(alloc)
-	if resizeNeeded(uintptr(len(data.index)), count) && m.resizing.CompareAndSwap(notResizing, resizingInProgress) {
-		m.grow(0) // double in size
+// GetOrComputeErr is similar to GetOrCompute but the value constructor can fail
+// the value constructor is called only if the key is absent
+// If the constructor returns an error then nothing is stored and the error is returned with `loaded` as false
+func (m *Map[K, V]) GetOrComputeErr(key K, valueFn func() (V, error)) (actual V, loaded bool, err error) {
+	h := m.hasher(key)
+	// try to get the element if present
+	for elem := m.metadata.Load().indexElement(h); elem != nil && elem.keyHash <= h; elem = elem.nextPtr.Load() {
+		if elem.key == key && !elem.isDeleted() {
+			if box := elem.value.Load(); !box.isExpired() {
+				actual, loaded = box.value, true
+				return
+			}
+		}
+	}
+	// Get() failed because element is absent
+	// compute the value from the constructor and store it only if it succeeded
+	value, err := valueFn()
+	if err != nil {
+		return
+	}
+	if alloc, _, stored := m.set(key, &value, 0, false); !stored {
+		return alloc.value.Load().value, true, nil
 	}
+	actual, loaded = value, false
 	return
 }
 
@@ -287,10 +762,23 @@ func (m *Map[K, V]) GetAndDel(key K) (value V, ok bool) {
 	}
 	for ; existing != nil && existing.keyHash <= h; existing = existing.next() {
 		if existing.key == key {
-			value, ok = *existing.value.Load(), !existing.isDeleted()
-			if existing.remove() {
-				m.removeItemFromIndex(existing)
-			}
+			value, ok = existing.value.Load().value, !existing.isDeleted()
+			m.removeItemFromIndex(existing, m.removeElement(existing))
+			return
+		}
+	}
+	return
+}
+
+// Pop removes and returns the first key-value pair in the map
+// Pairs are popped in ascending order of their key hashes and not in order of insertion
+// returns `false` only if the map is empty
+func (m *Map[K, V]) Pop() (key K, value V, ok bool) {
+	// on losing the race against a concurrent deletion of the same element move on to the next one
+	for item := m.listHead.nextLive(); item != nil; item = m.listHead.nextLive() {
+		if m.removeElement(item) {
+			m.removeItemFromIndex(item, true)
+			key, value, ok = item.key, item.value.Load().value, true
 			return
 		}
 	}
@@ -300,6 +788,9 @@ func (m *Map[K, V]) GetAndDel(key K) (value V, ok bool) {
 // CompareAndSwap atomically updates a map entry given its key by comparing current value to `oldValue`
 // and setting it to `newValue` if the above comparison is successful
 // It returns a boolean indicating whether the CompareAndSwap was successful or not
+// Values are compared via reflect.DeepEqual under which nil functions are equal but non-nil functions never equal
+// each other, not even themselves, hence it always fails for values holding non-nil functions directly or within
+// struct fields or arrays, see CompareAndSwapFunc and CompareVersionAndSwap for such types
 func (m *Map[K, V]) CompareAndSwap(key K, oldValue, newValue V) bool {
 	var (
 		h        = m.hasher(key)
@@ -309,16 +800,18 @@ func (m *Map[K, V]) CompareAndSwap(key K, oldValue, newValue V) bool {
 		existing = m.listHead
 	}
 	if _, current, _ := existing.search(h, key); current != nil {
-		if oldPtr := current.value.Load(); reflect.DeepEqual(*oldPtr, oldValue) {
-			return current.value.CompareAndSwap(oldPtr, &newValue)
+		// GetAndRefresh() replaces the box keeping the value, hence retry for as long as the value compares equal
+		for old := current.value.Load(); reflect.DeepEqual(old.value, oldValue); old = current.value.Load() {
+			if m.compareAndSwapValue(current, old, &newValue) {
+				return true
+			}
 		}
 	}
 	return false
 }
 
-// Swap atomically swaps the value of a map entry given its key
-// It returns the old value if swap was successful and a boolean `swapped` indicating whether the swap was successful or not
-func (m *Map[K, V]) Swap(key K, newValue V) (oldValue V, swapped bool) {
+// CompareAndSwapFunc is similar to CompareAndSwap but the current value is compared to `oldValue` via `eq`
+func (m *Map[K, V]) CompareAndSwapFunc(key K, oldValue, newValue V, eq func(V, V) bool) bool {
 	var (
 		h        = m.hasher(key)
 		existing = m.metadata.Load().indexElement(h)
@@ -327,70 +820,1075 @@ func (m *Map[K, V]) Swap(key K, newValue V) (oldValue V, swapped bool) {
 		existing = m.listHead
 	}
 	if _, current, _ := existing.search(h, key); current != nil {
-		oldValue, swapped = *current.value.Swap(&newValue), true
-	} else {
-		swapped = false
+		for old := current.value.Load(); eq(old.value, oldValue); old = current.value.Load() {
+			if m.compareAndSwapValue(current, old, &newValue) {
+				return true
+			}
+		}
 	}
-	return
+	return false
 }
 
-// ForEach iterates over key-value pairs and executes the lambda provided for each such pair
-// lambda must return `true` to continue iteration and `false` to break iteration
-func (m *Map[K, V]) ForEach(lambda func(K, V) bool) {
-	for item := m.listHead.next(); item != nil && lambda(item.key, *item.value.Load()); item = item.next() {
+// CompareAndSwapPtr is similar to CompareAndSwap but pointer values are compared by identity instead of by the values they point to
+// For maps whose values are not pointers it is same as CompareAndSwap
+func (m *Map[K, V]) CompareAndSwapPtr(key K, oldValue, newValue V) bool {
+	if kind := reflect.TypeOf(&oldValue).Elem().Kind(); kind != reflect.Ptr && kind != reflect.UnsafePointer {
+		return m.CompareAndSwap(key, oldValue, newValue)
 	}
+	return m.CompareAndSwapFunc(key, oldValue, newValue, func(a, b V) bool {
+		return *(*unsafe.Pointer)(unsafe.Pointer(&a)) == *(*unsafe.Pointer)(unsafe.Pointer(&b))
+	})
 }
 
-// Grow resizes the hashmap to a new size, gets rounded up to next power of 2
-// To double the size of the hashmap use newSize 0
-// No resizing is done in case of another resize operation already being in progress
-// Growth and map bucket policy is inspired from https://github.com/cornelk/hashmap
-func (m *Map[K, V]) Grow(newSize uintptr) {
-	if m.resizing.CompareAndSwap(notResizing, resizingInProgress) {
-		m.grow(newSize)
-	}
-}
+// GetWithVersion retrieves an element from the map along with the version of its value
+// The version is an opaque token which changes on every write to the key, to be used with CompareVersionAndSwap()
+// returns `false` if element is absent
+func (m *Map[K, V]) GetWithVersion(key K) (value V, version uint64, ok bool) {
+	h := m.hasher(key)
+	for elem := m.metadata.Load().indexElement(h); elem != nil && elem.keyHash <= h; elem = elem.nextPtr.Load() {
+		if elem.key == key {
+			box := elem.value.Load()
+			value, version, ok = box.value, box.version, !elem.isDeleted() && !box.isExpired()
+			return
+		}
+	}
+	return
+}
+
+// CompareVersionAndSwap atomically updates a map entry given its key if its version still equals `version`
+// as obtained from GetWithVersion(), avoiding any comparison of the values themselves
+// It returns a boolean indicating whether the swap was successful or not
+//
+// The version lives in the box holding the value (see valueBox) and every write replaces the box with a new one
+// holding the next version, so a value and its version are always published together by a single pointer CAS.
+// This method swaps in its box only while the current box still holds `version`, hence at most one caller
+// can succeed per version and any concurrent write makes it fail without taking a lock
+func (m *Map[K, V]) CompareVersionAndSwap(key K, version uint64, newValue V) bool {
+	var (
+		h        = m.hasher(key)
+		existing = m.metadata.Load().indexElement(h)
+	)
+	if existing == nil || existing.keyHash > h {
+		existing = m.listHead
+	}
+	if _, current, _ := existing.search(h, key); current != nil {
+		// GetAndRefresh() replaces the box keeping the version, hence retry for as long as the version matches
+		for box := current.value.Load(); box.version == version; box = current.value.Load() {
+			if m.compareAndSwapValue(current, box, &newValue) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// Swap atomically swaps the value of a map entry given its key
+// It returns the old value if swap was successful and a boolean `swapped` indicating whether the swap was successful or not
+func (m *Map[K, V]) Swap(key K, newValue V) (oldValue V, swapped bool) {
+	var (
+		h        = m.hasher(key)
+		existing = m.metadata.Load().indexElement(h)
+	)
+	if existing == nil || existing.keyHash > h {
+		existing = m.listHead
+	}
+	if _, current, _ := existing.search(h, key); current != nil {
+		m.beginWrite()
+		oldValue, swapped = current.replaceValue(&newValue, 0, true).value, true
+		m.endWrite()
+	} else {
+		swapped = false
+	}
+	return
+}
+
+// SetCopy sets a copy of the byte slice under the given key
+// Unlike Set the stored value does not alias the backing array of the caller, which is free to reuse its buffer afterwards
+// A nil slice is stored as nil
+func SetCopy[K hashable](m *Map[K, []byte], key K, value []byte) {
+	if value != nil {
+		value = append(make([]byte, 0, len(value)), value...)
+	}
+	m.set(key, &value, 0, true)
+}
+
+// GetAndSet always stores the value under the key and returns the previous value if the key was present
+// The loaded result is true if a previous value was replaced, false if the key was newly inserted
+func (m *Map[K, V]) GetAndSet(key K, value V) (previous V, loaded bool) {
+	h := m.hasher(key)
+	for {
+		existing := m.metadata.Load().indexElement(h)
+		if existing == nil || existing.keyHash > h {
+			existing = m.listHead
+		}
+		if _, current, _ := existing.search(h, key); current != nil && !current.isExpired() {
+			// a value stored into an element deleted meanwhile might be lost, see Drain(), hence it is set again
+			m.beginWrite()
+			old := current.replaceValue(&value, 0, false)
+			m.endWrite()
+			if !current.isDeleted() {
+				previous, loaded = old.value, true
+				return
+			}
+		}
+		if _, _, stored := m.set(key, &value, 0, false); stored {
+			return
+		}
+		// lost the insertion race against another writer, replace its value instead
+	}
+}
+
+// Add atomically adds `delta` to the value of a map entry given its key and returns the new value
+// The entry is inserted with value `delta` if absent
+func Add[K hashable, V constraints.Integer | constraints.Float](m *Map[K, V], key K, delta V) V {
+	h := m.hasher(key)
+	for {
+		existing := m.metadata.Load().indexElement(h)
+		if existing == nil || existing.keyHash > h {
+			existing = m.listHead
+		}
+		if _, current, _ := existing.search(h, key); current != nil && !current.isExpired() {
+			for {
+				old := current.value.Load()
+				newValue := old.value + delta
+				if m.compareAndSwapValue(current, old, &newValue) {
+					return newValue
+				}
+			}
+		}
+		if _, loaded := m.GetOrSet(key, delta); !loaded {
+			return delta
+		}
+		// lost the insertion race against another writer, add to its value instead
+	}
+}
+
+// SetIfGreater atomically stores the value under the key if the key is absent or if the value is greater than the current one
+// It returns whether the value was stored, useful for tracking the maximum seen per key
+func SetIfGreater[K hashable, V constraints.Ordered](m *Map[K, V], key K, value V) bool {
+	return setIf(m, key, value, func(current V) bool { return value > current })
+}
+
+// SetIfLess atomically stores the value under the key if the key is absent or if the value is less than the current one
+// It returns whether the value was stored, useful for tracking the minimum seen per key
+func SetIfLess[K hashable, V constraints.Ordered](m *Map[K, V], key K, value V) bool {
+	return setIf(m, key, value, func(current V) bool { return value < current })
+}
+
+// setIf stores the value under the key if the key is absent or if `replaces` returns true for the current value
+func setIf[K hashable, V any](m *Map[K, V], key K, value V, replaces func(current V) bool) bool {
+	h := m.hasher(key)
+	for {
+		existing := m.metadata.Load().indexElement(h)
+		if existing == nil || existing.keyHash > h {
+			existing = m.listHead
+		}
+		if _, current, _ := existing.search(h, key); current != nil && !current.isExpired() {
+			for {
+				old := current.value.Load()
+				if !replaces(old.value) {
+					return false
+				}
+				if m.compareAndSwapValue(current, old, &value) {
+					return true
+				}
+			}
+		}
+		if _, _, stored := m.set(key, &value, 0, false); stored {
+			return true
+		}
+		// lost the insertion race against another writer, compare against its value instead
+	}
+}
+
+// Min returns the live key-value pair with the smallest key hash, which is the first element of the list
+// ok is false if the map is empty
+func (m *Map[K, V]) Min() (key K, value V, ok bool) {
+	if item := m.listHead.nextLive(); item != nil {
+		key, value, ok = item.key, item.value.Load().value, true
+	}
+	return
+}
+
+// Max returns the live key-value pair with the largest key hash, which is the last element of the list
+// ok is false if the map is empty, unlike Min() this requires a full traversal of the list
+func (m *Map[K, V]) Max() (key K, value V, ok bool) {
+	var last *element[K, V]
+	for item := m.listHead.nextLive(); item != nil; item = item.nextLive() {
+		last = item
+	}
+	if last != nil {
+		key, value, ok = last.key, last.value.Load().value, true
+	}
+	return
+}
+
+// ForEach iterates over key-value pairs and executes the lambda provided for each such pair
+// lambda must return `true` to continue iteration and `false` to break iteration
+func (m *Map[K, V]) ForEach(lambda func(K, V) bool) {
+	for item := m.listHead.nextLive(); item != nil && lambda(item.key, item.value.Load().value); item = item.nextLive() {
+	}
+}
+
+// ForEachKey iterates over keys and executes the lambda provided for each key without loading its value
+// lambda must return `true` to continue iteration and `false` to break iteration
+func (m *Map[K, V]) ForEachKey(lambda func(K) bool) {
+	for item := m.listHead.nextLive(); item != nil && lambda(item.key); item = item.nextLive() {
+	}
+}
+
+// ForEachReverse iterates over key-value pairs in descending order of key hashes and executes the lambda provided for each such pair
+// lambda must return `true` to continue iteration and `false` to break iteration
+// As the list is singly linked, all live nodes are first collected into a slice which is then walked backwards
+func (m *Map[K, V]) ForEachReverse(lambda func(K, V) bool) {
+	items := make([]*element[K, V], 0, m.Len())
+	for item := m.listHead.nextLive(); item != nil; item = item.nextLive() {
+		items = append(items, item)
+	}
+	for i := len(items) - 1; i >= 0; i-- {
+		if item := items[i]; !item.isDeleted() && !lambda(item.key, item.value.Load().value) {
+			return
+		}
+	}
+}
+
+// ForEachSorted iterates over key-value pairs in the order defined by the less comparator and executes the lambda provided for each such pair
+// lambda must return `true` to continue iteration and `false` to break iteration
+// As the list is ordered by key hashes, all live pairs are first collected into a slice and sorted, costing O(n log n) time and O(n) memory
+func (m *Map[K, V]) ForEachSorted(less func(a, b K) bool, lambda func(K, V) bool) {
+	pairs := m.Snapshot()
+	sort.Slice(pairs, func(i, j int) bool { return less(pairs[i].Key, pairs[j].Key) })
+	for _, pair := range pairs {
+		if !lambda(pair.Key, pair.Value) {
+			return
+		}
+	}
+}
+
+// ForEachOrdered iterates over key-value pairs in order of insertion and executes the lambda provided for each such pair
+// lambda must return `true` to continue iteration and `false` to break iteration
+// Updating the value of an existing key does not change its position
+// Insertion order is only tracked for maps created with the WithInsertionOrder option, for other maps this is same as ForEach
+func (m *Map[K, V]) ForEachOrdered(lambda func(K, V) bool) {
+	if m.order == nil {
+		m.ForEach(lambda)
+		return
+	}
+	for node := m.order.first(); node != nil; node = node.next.Load() {
+		if item := node.elem; !item.isDeleted() {
+			if box := item.value.Load(); !box.isExpired() && !lambda(item.key, box.value) {
+				return
+			}
+		}
+	}
+}
+
+// ForEachBatch iterates over key-value pairs in batches of up to batchSize pairs and executes the lambda provided once per batch
+// lambda must return `true` to continue iteration and `false` to break iteration
+// The slices are reused for subsequent batches and must not be retained after the lambda returns
+func (m *Map[K, V]) ForEachBatch(batchSize int, lambda func([]K, []V) bool) {
+	if batchSize <= 0 {
+		return
+	}
+	b, _ := m.batches.Get().(*batch[K, V])
+	if b == nil || cap(b.keys) < batchSize {
+		b = &batch[K, V]{keys: make([]K, 0, batchSize), values: make([]V, 0, batchSize)}
+	}
+	defer func() {
+		// the pooled buffers must not keep the pairs of this iteration alive
+		b.reset()
+		m.batches.Put(b)
+	}()
+
+	keys, values := b.keys[:0], b.values[:0]
+	for item := m.listHead.nextLive(); item != nil; item = item.nextLive() {
+		keys, values = append(keys, item.key), append(values, item.value.Load().value)
+		if len(keys) == batchSize {
+			if !lambda(keys, values) {
+				return
+			}
+			keys, values = keys[:0], values[:0]
+		}
+	}
+	if len(keys) > 0 {
+		lambda(keys, values)
+	}
+}
+
+// reset zeroes the buffers of the batch up to their capacity
+func (b *batch[K, V]) reset() {
+	var (
+		zeroKey   K
+		zeroValue V
+		keys      = b.keys[:cap(b.keys)]
+		values    = b.values[:cap(b.values)]
+	)
+	for i := range keys {
+		keys[i] = zeroKey
+	}
+	for i := range values {
+		values[i] = zeroValue
+	}
+}
+
+// ForEachIndexed iterates over key-value pairs and executes the lambda provided for each such pair along with its position
+// the position starts at 0 and only counts live pairs
+// lambda must return `true` to continue iteration and `false` to break iteration
+func (m *Map[K, V]) ForEachIndexed(lambda func(int, K, V) bool) {
+	i := 0
+	for item := m.listHead.nextLive(); item != nil && lambda(i, item.key, item.value.Load().value); item = item.nextLive() {
+		i++
+	}
+}
+
+// TransformValues replaces the value of every pair with the result of the lambda provided for that pair
+// Each value is replaced via a CAS loop, so the lambda is called again with the new value if a concurrent writer changed it
+// It is weakly consistent, pairs inserted during the pass may or may not be transformed
+func (m *Map[K, V]) TransformValues(lambda func(K, V) V) {
+	for item := m.listHead.nextLive(); item != nil; item = item.nextLive() {
+		for {
+			old := item.value.Load()
+			newValue := lambda(item.key, old.value)
+			if m.compareAndSwapValue(item, old, &newValue) {
+				break
+			}
+		}
+	}
+}
+
+// ParallelForEach iterates over key-value pairs with `workers` goroutines executing the lambda provided for each such pair
+// The index is partitioned into `workers` contiguous ranges of slots and every goroutine only visits the elements whose
+// key hash falls into its range, so each pair is visited exactly once even if colliding hashes straddle a range boundary
+// It returns after all goroutines finished, the lambda must be safe for concurrent use
+func (m *Map[K, V]) ParallelForEach(workers int, lambda func(K, V)) {
+	data := m.metadata.Load()
+	if data == nil {
+		return
+	}
+	slots := len(data.index)
+	if workers > slots {
+		workers = slots
+	}
+	if workers < 1 {
+		workers = 1
+	}
+
+	var wg sync.WaitGroup
+	for w := 0; w < workers; w++ {
+		var (
+			lo   = uintptr(slots*w/workers) << data.keyshifts
+			hi   = uintptr(slots*(w+1)/workers) << data.keyshifts
+			last = w == workers-1 // the upper bound of the last range would overflow to 0
+		)
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			item := data.indexElement(lo)
+			for item != nil && item.keyHash < lo {
+				item = item.next()
+			}
+			for ; item != nil && (last || item.keyHash < hi); item = item.next() {
+				if box := item.value.Load(); !box.isExpired() {
+					lambda(item.key, box.value)
+				}
+			}
+		}()
+	}
+	wg.Wait()
+}
+
+// Range iterates over key-value pairs and executes the lambda provided for each such pair
+// iteration stops at the first non-nil error returned by the lambda and that error is returned
+func (m *Map[K, V]) Range(lambda func(K, V) error) error {
+	for item := m.listHead.nextLive(); item != nil; item = item.nextLive() {
+		if err := lambda(item.key, item.value.Load().value); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// RangeCollect is similar to Range but iteration continues past errors
+// All non-nil errors returned by the lambda are collected in iteration order, nil is returned if there were none
+func (m *Map[K, V]) RangeCollect(lambda func(K, V) error) (errs []error) {
+	for item := m.listHead.nextLive(); item != nil; item = item.nextLive() {
+		if err := lambda(item.key, item.value.Load().value); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return
+}
+
+// AppendKeys appends all keys of the map to dst and returns the extended slice
+// Deleted items are skipped, items set or deleted concurrently may or may not be included
+func (m *Map[K, V]) AppendKeys(dst []K) []K {
+	for item := m.listHead.nextLive(); item != nil; item = item.nextLive() {
+		dst = append(dst, item.key)
+	}
+	return dst
+}
+
+// AppendValues appends all values of the map to dst and returns the extended slice
+// Deleted items are skipped, items set or deleted concurrently may or may not be included
+func (m *Map[K, V]) AppendValues(dst []V) []V {
+	for item := m.listHead.nextLive(); item != nil; item = item.nextLive() {
+		dst = append(dst, item.value.Load().value)
+	}
+	return dst
+}
+
+// Snapshot returns all key-value pairs of the map in a single pass over the list in ascending order of key hashes
+// Each key occurs at most once even if the map is resized concurrently, as resizing only rebuilds the index and never moves list nodes
+// This is a best-effort consistent snapshot and not an atomic one, a write concurrent to the call is included
+// if it happened before the traversal passed its position, so the staleness window is bounded by the duration of one traversal
+// Readers which must see a coherent state of the map while writers continue should use BeginReadView() instead
+func (m *Map[K, V]) Snapshot() []Pair[K, V] {
+	pairs := make([]Pair[K, V], 0, m.Len())
+	for item := m.listHead.nextLive(); item != nil; item = item.nextLive() {
+		pairs = append(pairs, Pair[K, V]{Key: item.key, Value: item.value.Load().value})
+	}
+	return pairs
+}
+
+// CountFunc returns the number of entries for which `pred` returns true in a single pass over the list without allocating
+// Deleted elements are skipped, prefer it over Filter() if only the count is needed
+func (m *Map[K, V]) CountFunc(pred func(K, V) bool) (count uintptr) {
+	for item := m.listHead.nextLive(); item != nil; item = item.nextLive() {
+		if pred(item.key, item.value.Load().value) {
+			count++
+		}
+	}
+	return
+}
+
+// Entries returns all key-value pairs of the map, built in a single pass over the list
+// so that every key is paired with the value it held at the time it was visited, unlike separate AppendKeys() and AppendValues() calls
+// The result is the same as Snapshot(), Pair is the entry type of the map
+func (m *Map[K, V]) Entries() []Pair[K, V] {
+	return m.Snapshot()
+}
+
+// Filter returns a new map containing the key-value pairs for which `pred` returns true
+// Every value is loaded atomically once and passed to `pred`, deleted elements are skipped
+func (m *Map[K, V]) Filter(pred func(K, V) bool) map[K]V {
+	matches := make(map[K]V)
+	for item := m.listHead.nextLive(); item != nil; item = item.nextLive() {
+		if key, value := item.key, item.value.Load().value; pred(key, value) {
+			matches[key] = value
+		}
+	}
+	return matches
+}
+
+// Grow resizes the hashmap to a new size, gets rounded up to next power of 2
+// To double the size of the hashmap use newSize 0
+// No resizing is done in case of another resize operation already being in progress
+// Growth and map bucket policy is inspired from https://github.com/cornelk/hashmap
+// It panics if newSize exceeds the largest power of 2 representable by uintptr
+func (m *Map[K, V]) Grow(newSize uintptr) {
+	if newSize > maxIndexSize {
+		panic(fmt.Sprintf("haxmap: Grow size %d exceeds the maximum index size %d", newSize, uintptr(maxIndexSize)))
+	}
+	if m.resizing.CompareAndSwap(notResizing, resizingInProgress) {
+		m.grow(newSize)
+	}
+}
+
+// Reserve grows the map if required to hold `additional` more items on top of Len() without any intermediate resizing
+// Existing entries are retained, in case of a concurrent resize it waits for that to finish and then checks again
+func (m *Map[K, V]) Reserve(additional uintptr) {
+	for {
+		size := m.capacityFor(m.Len() + additional)
+		if size <= m.metadata.Load().size() {
+			return
+		}
+		if m.resizing.CompareAndSwap(notResizing, resizingInProgress) {
+			m.grow(size)
+			return
+		}
+		m.WaitResize()
+	}
+}
+
+// IsResizing reports whether a resize operation is currently in progress
+// Latency-sensitive writers can use it to defer writes during a resize, see WaitResize() for waiting on it
+func (m *Map[K, V]) IsResizing() bool {
+	return m.resizing.Load() == resizingInProgress
+}
+
+// casBackoff is the number of consecutive failed attempts of a contended retry loop after which it yields the processor, 0 to never yield
+var casBackoff = atomicUint32{v: defaultCASBackoff}
+
+// SetCASBackoff sets the number of consecutive failed attempts after which the retry loops of insertions and deletions
+// which lost a race against concurrent writers yield the processor via runtime.Gosched() before every further attempt
+// This saves CPU time under heavy contention on the same keys, 0 disables yielding. It applies to all maps
+func SetCASBackoff(attempts uint32) {
+	casBackoff.Store(attempts)
+}
+
+// backoff yields the processor if a retry loop failed at least casBackoff times in a row
+// the uncontended path never gets here and a failed first retry only pays a single atomic load
+func backoff(attempt uint32) {
+	if threshold := casBackoff.Load(); threshold > 0 && attempt >= threshold {
+		runtime.Gosched()
+	}
+}
+
+// WaitResize blocks until no resize operation is in progress
+// It is intended for tests and quiescent points like asserting on the table size after a bulk load, not for the hot path
+func (m *Map[K, V]) WaitResize() {
+	for m.resizing.Load() == resizingInProgress {
+		runtime.Gosched()
+	}
+}
+
+// Reindex re-adds the first live element of every index slot to the current index
+// Lookups of elements missing from the index have to scan the list from a preceding slot, so this restores O(1) lookups
+// in case the index ever got out of sync with the list. It only adds index entries and is safe to call concurrently
+func (m *Map[K, V]) Reindex() {
+	if data := m.metadata.Load(); data != nil {
+		m.fillIndexItems(data)
+	}
+}
+
+// Compact moves all live elements into a single contiguous array and rebuilds the list and the index on top of it
+// Every element is a separate heap allocation by default, hence traversals chase pointers all over the heap
+// whereas after compaction ForEach() and other full scans walk memory sequentially
+//
+// It must only be called at a quiescent point where no writer is in progress, neither in another goroutine nor in
+// the caller itself, e.g. from the callback of TransformValues(), RemoveWhile() or OnResize().
+// A writer holding an element from before the compaction updates a node which is no longer part of the list,
+// hence its write is lost. Writers are not synchronized with Compact() on purpose, so that every other write
+// does not pay for it. Concurrent readers keep traversing the old nodes, except for ForEachOrdered() on maps
+// tracking the insertion order which must not run concurrently either
+// The array is only freed once all its elements became unreachable, so deleting most keys after a compaction
+// keeps the memory of the whole array alive until the next compaction or until the remaining keys are deleted as well
+func (m *Map[K, V]) Compact() {
+	for !m.resizing.CompareAndSwap(notResizing, resizingInProgress) {
+		m.WaitResize()
+	}
+	var items []*element[K, V]
+	for item := m.listHead.next(); item != nil; item = item.next() {
+		items = append(items, item)
+	}
+
+	arena := make([]element[K, V], len(items))
+	for i, item := range items {
+		elem := &arena[i]
+		elem.keyHash, elem.key = item.keyHash, item.key
+		// boxes are immutable, hence the compacted element shares the box along with its version and expiry
+		elem.value.Store(item.value.Load())
+		if m.order != nil {
+			m.order.move(item, elem)
+		}
+		if i+1 < len(arena) {
+			elem.nextPtr.Store(&arena[i+1])
+		}
+	}
+	if len(arena) > 0 {
+		m.listHead.nextPtr.Store(&arena[0])
+	} else {
+		m.listHead.nextPtr.Store(nil)
+	}
+
+	if size := m.metadata.Load().size(); size > 0 {
+		data := m.newMetadata(size)
+		m.fillIndexItems(data)
+		m.metadata.Store(data)
+	}
+	m.resizing.Store(notResizing)
+}
 
 // Clear the map by removing all entries in the map.
 // This operation resets the underlying metadata to its initial state.
 func (m *Map[K, V]) Clear() {
-	index := make([]*element[K, V], m.defaultSize)
-	header := (*reflect.SliceHeader)(unsafe.Pointer(&index))
-	newdata := &metadata[K, V]{
-		keyshifts: strconv.IntSize - log2(m.defaultSize),
-		data:      unsafe.Pointer(header.Data),
-		index:     index,
+	m.beginWrite()
+	m.listHead.nextPtr.Store(nil)
+	m.metadata.Store(m.newMetadata(m.defaultSize))
+	m.endWrite()
+	m.numItems.Store(0)
+	if m.order != nil {
+		m.order.reset()
+	}
+}
+
+// Drain empties the map and returns all the key-value pairs it contained
+// The list is detached from the map in a single atomic step, so a concurrent Get() either sees the old entries or an empty map
+// The returned map is built from the detached list afterwards. A write storing a value regardless of the current one,
+// like Set() or GetAndSet(), racing with Drain() either lands in the detached list and is part of the result or is retried
+// on the emptied map and remains in it, possibly both, but never gets lost. Conditional updates of present keys like
+// Swap(), CompareAndSwap(), Add() or TransformValues() cannot be retried without applying them twice, hence if they
+// race with Drain() they might report success for an element which got drained already with its previous value
+// Expired entries are dropped without being returned
+func (m *Map[K, V]) Drain() map[K]V {
+	for !m.resizing.CompareAndSwap(notResizing, resizingInProgress) {
+		m.WaitResize()
+	}
+	// swapping in an empty index first makes lookups fall back to scanning the list until it gets detached
+	m.beginWrite()
+	m.metadata.Store(m.newMetadata(m.defaultSize))
+	first := m.listHead.nextPtr.Load()
+	for !m.listHead.nextPtr.CompareAndSwap(first, nil) {
+		first = m.listHead.nextPtr.Load()
+	}
+	m.endWrite()
+	if m.order != nil {
+		m.order.reset()
+	}
+	m.resizing.Store(notResizing)
+
+	drained := make(map[K]V)
+	for item := first; item != nil; item = item.nextPtr.Load() {
+		// marking a detached element deleted freezes its link, so a writer still walking the detached list either links its
+		// element in front of this cursor where it gets drained as well, or fails on a marked element and retries on the map
+		// elements deleted concurrently are accounted for by the deleting caller
+		if !item.remove() {
+			continue
+		}
+		if m.order != nil {
+			m.order.unlink(item)
+		}
+		m.numItems.Add(^uintptr(0)) // decrement counter
+		if box := item.value.Load(); !box.isExpired() {
+			drained[item.key] = box.value
+		}
+	}
+	return drained
+}
+
+// Clone returns a new map containing all the key-value pairs present in the map
+// The new map uses the same hash function and is pre-allocated to hold all the pairs without resizing
+// Values are copied by assignment so pointer values are shared between both maps, entries keep their expiry and expired ones are left out
+// If the map is modified concurrently then the clone might or might not contain those modifications
+func (m *Map[K, V]) Clone() *Map[K, V] {
+	clone := New[K, V](m.Len() * 100 / m.maxFillRate.Load())
+	clone.storeHasher(m.loadHasher())
+	clone.maxFillRate.Store(m.maxFillRate.Load())
+	clone.growthBits.Store(m.growthBits.Load())
+	clone.defaultSize = m.defaultSize
+	clone.fixedSize.Store(m.fixedSize.Load())
+	for item := m.listHead.nextLive(); item != nil; item = item.nextLive() {
+		clone.copyItem(item)
+	}
+	return clone
+}
+
+// Split partitions the entries of the map into `n` new maps in a single traversal of the list
+// The hash space is divided into `n` contiguous ranges of equal size and shard i holds the entries whose key hashes fall into range i,
+// i.e. the shard of a key is the upper word of KeyHash(key) * n. The shards use the same hash function as the map
+// Values are copied by assignment keeping their expiry and the map itself is left untouched, it panics if n is less than 1
+func (m *Map[K, V]) Split(n int) []*Map[K, V] {
+	if n < 1 {
+		panic(fmt.Sprintf("haxmap: Split called with %d shards", n))
+	}
+	shards := make([]*Map[K, V], n)
+	for i := range shards {
+		shards[i] = NewWithOptions(WithHasher[K, V](m.loadHasher()), WithMaxFillRate[K, V](m.maxFillRate.Load()))
+		shards[i].Reserve(m.Len() / uintptr(n))
+	}
+	for item := m.listHead.nextLive(); item != nil; item = item.nextLive() {
+		shard, _ := bits.Mul(uint(item.keyHash), uint(n))
+		shards[shard].copyItem(item)
+	}
+	return shards
+}
+
+// MergeShards combines the entries of several maps into a new one, the inverse of Split()
+// The new map uses the hash function and fill rate of the first shard and is pre-allocated to hold all entries without resizing
+// Keys are expected to be disjoint, if a key is present in several shards then the value of the last of those shards wins
+// Entries keep their expiry, expired ones are left out
+// Every shard is inserted in ascending order of key hashes which walks the list and the index of the new map sequentially
+func MergeShards[K hashable, V any](shards []*Map[K, V]) *Map[K, V] {
+	if len(shards) == 0 {
+		return New[K, V]()
+	}
+	var total uintptr
+	for _, shard := range shards {
+		total += shard.Len()
+	}
+	m := NewWithOptions(WithHasher[K, V](shards[0].loadHasher()), WithMaxFillRate[K, V](shards[0].maxFillRate.Load()))
+	m.Reserve(total)
+	for _, shard := range shards {
+		for item := shard.listHead.nextLive(); item != nil; item = item.nextLive() {
+			m.copyItem(item)
+		}
+	}
+	return m
+}
+
+// Equal reports whether both maps contain the same set of keys with every pair of corresponding values satisfying `eq`
+// Maps of different lengths are unequal without a traversal and otherwise only `m` is traversed
+// Entries whose TTL elapsed are ignored, but as they are counted until removed the lengths cannot be compared
+// once either map holds entries with a TTL, in which case `other` is traversed as well to count its live entries
+func (m *Map[K, V]) Equal(other *Map[K, V], eq func(V, V) bool) bool {
+	if m.expiring.Load() == 0 && other.expiring.Load() == 0 {
+		if m.Len() != other.Len() {
+			return false
+		}
+		for item := m.listHead.next(); item != nil; item = item.next() {
+			if value, ok := other.Get(item.key); !ok || !eq(item.value.Load().value, value) {
+				return false
+			}
+		}
+		return true
 	}
-	m.listHead.nextPtr.Store(nil)
-	m.metadata.Store(newdata)
-	m.numItems.Store(0)
+	var count int
+	for item := m.listHead.nextLive(); item != nil; item = item.nextLive() {
+		if value, ok := other.Get(item.key); !ok || !eq(item.value.Load().value, value) {
+			return false
+		}
+		count++
+	}
+	for item := other.listHead.nextLive(); item != nil; item = item.nextLive() {
+		count--
+	}
+	return count == 0
+}
+
+// KeyHash returns the hash of the key as computed by the hash function of the map
+// It allows routing keys to shards via the same hash the map uses internally
+func (m *Map[K, V]) KeyHash(key K) uintptr {
+	return m.hasher(key)
 }
 
 // SetHasher sets the hash function to the one provided by the user
+// The function is swapped atomically, so calling it concurrently with other operations is memory-safe,
+// but operations racing with the swap may hash with the old function and existing entries are not re-hashed
 func (m *Map[K, V]) SetHasher(hs func(K) uintptr) {
-	m.hasher = hs
+	m.storeHasher(hs)
+}
+
+// UseClassicStringHash sets the hash function of a map with string keys to the unseeded classic xxHash
+// Every build hashes strings with classic xxHash by default so this only matters after SetHasher or SetSeededHasher
+// The same key always hashes to the same value across processes and builds of the same word size
+// which keeps hash ranges and bucket assignments stable for persisted or sharded data
+// It must be called on an empty map as existing entries would be unreachable with the new hash function
+func (m *Map[K, V]) UseClassicStringHash() {
+	if reflect.TypeOf(*new(K)).Kind() != reflect.String {
+		panic(fmt.Sprintf("haxmap: UseClassicStringHash called on a map with non-string key type %v", reflect.TypeOf(*new(K))))
+	}
+	if m.Len() != 0 {
+		panic("haxmap: UseClassicStringHash called on a non-empty map")
+	}
+	m.storeHasher(DefaultHasher[K]())
+}
+
+// SetSeededHasher sets the hash function to xxHash keyed by the given seed
+// Randomizing the seed per process or per map protects against hash flooding by untrusted keys
+// It must be called on an empty map as existing entries would be unreachable with the new hash function
+func (m *Map[K, V]) SetSeededHasher(seed uint64) {
+	if m.Len() != 0 {
+		panic("haxmap: SetSeededHasher called on a non-empty map")
+	}
+	m.storeHasher(seededHasher[K](seed))
+}
+
+// SetMaxFillRate sets the fill rate percentage of the map index beyond which the map is resized, defaults to 50
+// Higher fill rates trade lookup speed for lower memory usage, the value is clamped to the range [10, 90]
+func (m *Map[K, V]) SetMaxFillRate(percent uintptr) {
+	if percent < 10 {
+		percent = 10
+	} else if percent > 90 {
+		percent = 90
+	}
+	m.maxFillRate.Store(percent)
+}
+
+// SetGrowthFactor sets the factor by which the map grows when resized automatically, defaults to 2
+// The index is bucketed by the top bits of key hashes, hence its size is always a power of 2 and the grown size
+// is rounded up to the next one. Factors below 2 would still double the index, so they are ignored
+func (m *Map[K, V]) SetGrowthFactor(factor float64) {
+	if factor >= 2.0 && !math.IsInf(factor, 1) {
+		m.growthBits.Store(math.Float64bits(factor))
+	}
+}
+
+// SetAutoGrow enables or disables automatic resizing of the map, enabled by default
+// With auto-grow disabled the index size is pinned and only changes via explicit calls to Grow() or Reserve()
+// This trades memory for latency, inserts never pause for a resize but lookups degrade gracefully into longer scans
+// of the list once the fill rate is exceeded, so the map should be pre-sized generously via New(size)
+func (m *Map[K, V]) SetAutoGrow(enabled bool) {
+	if enabled {
+		m.fixedSize.Store(0)
+	} else {
+		m.fixedSize.Store(1)
+	}
+}
+
+// OnResize registers a callback invoked after every completed resize with the previous and the new index length
+// The callback runs after the resize has finished and may call back into the map, pass nil to unregister
+func (m *Map[K, V]) OnResize(cb func(oldSize, newSize uintptr)) {
+	if cb == nil {
+		m.onResize.Store(nil)
+		return
+	}
+	m.onResize.Store(&cb)
 }
 
 // Len returns the number of key-value pairs within the map
+// It is a fast O(1) counter which might transiently differ from the actual number of live entries during concurrent modifications
 func (m *Map[K, V]) Len() uintptr {
 	return m.numItems.Load()
 }
 
+// Capacity returns the number of slots of the index, which is always a power of 2
+// It is the size passed to New() or Grow() rounded up, or larger if the map resized since
+// A lazily created map has a capacity of 0 until its first insertion
+func (m *Map[K, V]) Capacity() uintptr {
+	return m.metadata.Load().size()
+}
+
+// LiveLen returns the authoritative number of key-value pairs within the map by counting all non-deleted nodes
+// It is O(n), use Len() for the fast counter
+func (m *Map[K, V]) LiveLen() (count uintptr) {
+	for item := m.listHead.next(); item != nil; item = item.next() {
+		count++
+	}
+	return
+}
+
+// PendingDeletions returns the number of nodes which are marked deleted but are yet to be unlinked from the list
+// it traverses the raw list without unlinking any node and is meant only for diagnosis as it is O(n)
+func (m *Map[K, V]) PendingDeletions() int {
+	count := 0
+	for item := m.listHead.nextPtr.Load(); item != nil; item = item.nextPtr.Load() {
+		if item.isDeleted() {
+			count++
+		}
+	}
+	return count
+}
+
+// EnableMetrics starts counting the hits and misses of lookups via Get and the collisions of insertions, the counters start from zero
+// Metrics are disabled by default so that Get and the insertion methods do not pay for the atomic increments
+func (m *Map[K, V]) EnableMetrics() {
+	m.metrics.Store(new(metrics))
+}
+
+// EnableWriteLog starts recording every insertion, update and deletion of a key into a ring buffer retaining the last `size` writes
+// (1024 if size is not given) along with the goroutine which performed it, the log can be read via DumpWriteLog
+// Enabling it again discards the previously recorded writes
+//
+// This is meant for debugging, e.g. to reveal the interleaving of writes which led to a Validate() failure
+// Every logged write takes a mutex and captures a stack trace header, hence it is disabled by default
+// in which case writers only pay a single atomic load. In-place value swaps via Swap(), CompareAndSwap() and
+// their variants, Add() and bulk value transformations are not logged as they do not alter the list or the index
+func (m *Map[K, V]) EnableWriteLog(size ...uintptr) {
+	n := uintptr(defaultWriteLogSize)
+	if len(size) > 0 && size[0] > 0 {
+		n = size[0]
+	}
+	m.writeLog.Store(newWriteLog[K](n))
+}
+
+// DumpWriteLog returns the writes retained by the write log from the oldest to the newest
+// It returns nil if the write log was not enabled via EnableWriteLog
+func (m *Map[K, V]) DumpWriteLog() []LogEntry[K] {
+	if wl := m.writeLog.Load(); wl != nil {
+		return wl.dump()
+	}
+	return nil
+}
+
+// Metrics returns the number of Get calls which found the key, which did not find it
+// and the number of insertions or updates whose search walked past at least one element of another key in the same index slot
+// All counters are 0 if metrics were not enabled via EnableMetrics
+func (m *Map[K, V]) Metrics() (hits, misses, collisions uint64) {
+	if mt := m.metrics.Load(); mt != nil {
+		hits, misses, collisions = mt.hits.Load(), mt.misses.Load(), mt.collisions.Load()
+	}
+	return
+}
+
+// DescribeMetrics returns the internal statistics of the map keyed by metric name for exporting to monitoring systems
+// such as a prometheus collector without adding such a dependency to this package
+// The lookup counters are only populated if enabled via EnableMetrics
+func (m *Map[K, V]) DescribeMetrics() map[string]float64 {
+	hits, misses, collisions := m.Metrics()
+	return map[string]float64{
+		"len":        float64(m.Len()),
+		"capacity":   float64(m.Capacity()),
+		"fill_rate":  m.FillRateFloat(),
+		"resizes":    float64(m.resizes.Load()),
+		"hits":       float64(hits),
+		"misses":     float64(misses),
+		"collisions": float64(collisions),
+	}
+}
+
+// Validate checks the internal invariants of the map and returns a descriptive error for the first violation found
+// The list must be sorted in ascending order of key hashes without duplicate keys, every live index entry must point
+// to a node reachable from the list in its own slot and the item counter must match the number of live nodes
+// Meant for tests and debugging, the result is only reliable while the map is not modified concurrently
+func (m *Map[K, V]) Validate() error {
+	var (
+		live  = make(map[*element[K, V]]struct{})
+		count uintptr
+		prev  *element[K, V]
+	)
+	for item := m.listHead.next(); item != nil; prev, item = item, item.next() {
+		if prev != nil {
+			if prev.keyHash > item.keyHash {
+				return fmt.Errorf("haxmap: list not sorted, key %v with hash %#x precedes key %v with hash %#x", prev.key, prev.keyHash, item.key, item.keyHash)
+			}
+			if prev.keyHash == item.keyHash && prev.key == item.key {
+				return fmt.Errorf("haxmap: duplicate key %v in list", item.key)
+			}
+		}
+		live[item] = struct{}{}
+		count++
+	}
+
+	if data := m.metadata.Load(); data != nil {
+		for i, item := range data.index {
+			if item == nil || item.isDeleted() {
+				continue
+			}
+			if _, ok := live[item]; !ok {
+				return fmt.Errorf("haxmap: index slot %d points to key %v which is not reachable from the list", i, item.key)
+			}
+			if slot := item.keyHash >> data.keyshifts; slot != uintptr(i) {
+				return fmt.Errorf("haxmap: index slot %d points to key %v which belongs to slot %d", i, item.key, slot)
+			}
+		}
+	}
+
+	if n := m.Len(); n != count {
+		return fmt.Errorf("haxmap: item counter is %d but the list contains %d live items", n, count)
+	}
+	return nil
+}
+
 // Fillrate returns the fill rate of the map as an percentage integer
 func (m *Map[K, V]) Fillrate() uintptr {
 	data := m.metadata.Load()
+	if data == nil {
+		return 0
+	}
 	return (data.count.Load() * 100) / uintptr(len(data.index))
 }
 
+// FillRateFloat returns the fill rate of the map as a fraction between 0 and 1 with sub-percent precision
+// 0 is returned for an index of length zero
+func (m *Map[K, V]) FillRateFloat() float64 {
+	data := m.metadata.Load()
+	if data.size() == 0 {
+		return 0
+	}
+	return float64(data.count.Load()) / float64(len(data.index))
+}
+
+// MemoryUsage returns an estimate of the memory held by the map in bytes
+// It accounts for the map and index structures and for every list node including deleted nodes which are not unlinked yet,
+// each node being an element plus the separately allocated box of its value (and its insertion order node along with
+// its entry in the side table if tracked)
+// Memory referenced by keys and values like string contents or slice backing arrays is not included
+// It requires a full traversal of the list
+func (m *Map[K, V]) MemoryUsage() uintptr {
+	usage := unsafe.Sizeof(*m)
+	if data := m.metadata.Load(); data != nil {
+		usage += unsafe.Sizeof(*data) + uintptr(len(data.index))*intSizeBytes
+	}
+	node := unsafe.Sizeof(element[K, V]{}) + unsafe.Sizeof(valueBox[V]{})
+	if m.order != nil {
+		node += unsafe.Sizeof(orderNode[K, V]{}) + 2*intSizeBytes
+	}
+	for item := m.listHead; item != nil; item = item.nextPtr.Load() {
+		usage += node
+	}
+	return usage
+}
+
+// BucketSizes returns the number of live entries per index slot, element i is the count of entries whose hash maps to slot i
+// Meant for diagnosing the hash distribution, it requires a full traversal of the list
+func (m *Map[K, V]) BucketSizes() []int {
+	data := m.metadata.Load()
+	if data == nil {
+		return nil
+	}
+	sizes := make([]int, len(data.index))
+	for item := m.listHead.next(); item != nil; item = item.next() {
+		sizes[item.keyHash>>data.keyshifts]++
+	}
+	return sizes
+}
+
+// String returns a human-readable dump of the key-value pairs in the map meant for debugging, implements the fmt.Stringer interface.
+// At most the first 32 pairs are printed, followed by an ellipsis if there are more
+// Keys and values implementing fmt.Stringer are printed via their String() method
+func (m *Map[K, V]) String() string {
+	const maxEntries = 32
+	var sb strings.Builder
+	sb.WriteString("map[")
+	count := 0
+	for i := m.listHead.nextLive(); i != nil; i = i.nextLive() {
+		if count > 0 {
+			sb.WriteByte(' ')
+		}
+		if count == maxEntries {
+			sb.WriteString("...")
+			break
+		}
+		fmt.Fprintf(&sb, "%v:%v", i.key, i.value.Load().value)
+		count++
+	}
+	sb.WriteByte(']')
+	return sb.String()
+}
+
 // MarshalJSON implements the json.Marshaler interface.
 func (m *Map[K, V]) MarshalJSON() ([]byte, error) {
 	gomap := make(map[K]V)
-	for i := m.listHead.next(); i != nil; i = i.next() {
-		gomap[i.key] = *i.value.Load()
+	for i := m.listHead.nextLive(); i != nil; i = i.nextLive() {
+		gomap[i.key] = i.value.Load().value
 	}
 	return json.Marshal(gomap)
 }
 
+// WriteJSON streams the map as a JSON object to the given writer
+// Entries are encoded incrementally while traversing the list once, keeping memory usage bounded for large maps
+// Keys are encoded following the rules of encoding/json, i.e. integer keys are stringified
+// and other non-string keys are only supported if they implement encoding.TextMarshaler
+func (m *Map[K, V]) WriteJSON(w io.Writer) error {
+	buf := bufio.NewWriter(w)
+	if err := buf.WriteByte('{'); err != nil {
+		return err
+	}
+	for i, first := m.listHead.nextLive(), true; i != nil; i, first = i.nextLive(), false {
+		key, err := jsonKey(i.key)
+		if err != nil {
+			return err
+		}
+		// json.Marshal is used instead of a json.Encoder which terminates every token with a newline
+		encodedKey, err := json.Marshal(key)
+		if err != nil {
+			return err
+		}
+		encodedValue, err := json.Marshal(i.value.Load().value)
+		if err != nil {
+			return err
+		}
+		if !first {
+			if err = buf.WriteByte(','); err != nil {
+				return err
+			}
+		}
+		if _, err = buf.Write(encodedKey); err != nil {
+			return err
+		}
+		if err = buf.WriteByte(':'); err != nil {
+			return err
+		}
+		if _, err = buf.Write(encodedValue); err != nil {
+			return err
+		}
+	}
+	if err := buf.WriteByte('}'); err != nil {
+		return err
+	}
+	return buf.Flush()
+}
+
 // UnmarshalJSON implements the json.Unmarshaler interface.
 func (m *Map[K, V]) UnmarshalJSON(i []byte) error {
 	gomap := make(map[K]V)
@@ -398,12 +1896,82 @@ func (m *Map[K, V]) UnmarshalJSON(i []byte) error {
 	if err != nil {
 		return err
 	}
+	m.Reserve(uintptr(len(gomap)))
+	for k, v := range gomap {
+		m.Set(k, v)
+	}
+	return nil
+}
+
+// GobEncode implements the gob.GobEncoder interface.
+func (m *Map[K, V]) GobEncode() ([]byte, error) {
+	gomap := make(map[K]V)
+	for i := m.listHead.nextLive(); i != nil; i = i.nextLive() {
+		gomap[i.key] = i.value.Load().value
+	}
+	var buf bytes.Buffer
+	if err := gob.NewEncoder(&buf).Encode(gomap); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// GobDecode implements the gob.GobDecoder interface.
+// A zero valued map (as allocated by the gob decoder for nil pointers) is initialized before decoding
+func (m *Map[K, V]) GobDecode(i []byte) error {
+	if m.listHead == nil {
+		m.init(defaultSize)
+		m.requireHasher()
+	}
+	if len(i) == 0 {
+		return nil
+	}
+	gomap := make(map[K]V)
+	if err := gob.NewDecoder(bytes.NewReader(i)).Decode(&gomap); err != nil {
+		return err
+	}
 	for k, v := range gomap {
 		m.Set(k, v)
 	}
 	return nil
 }
 
+// capacityFor returns the index size required to hold `count` items without exceeding the maximum fill rate
+func (m *Map[K, V]) capacityFor(count uintptr) uintptr {
+	rate := m.maxFillRate.Load()
+	if count > (maxIndexSize-rate)/100 { // guard against overflow
+		return maxIndexSize
+	}
+	return (count*100 + rate - 1) / rate
+}
+
+// init initializes a zero valued map with the given size
+func (m *Map[K, V]) init(size uintptr) {
+	m.initLazy(size)
+	m.allocate(m.defaultSize)
+}
+
+// initLazy initializes a zero valued map with the given size without allocating its index
+func (m *Map[K, V]) initLazy(size uintptr) {
+	m.listHead = newListHead[K, V]()
+	m.numItems.Store(0)
+	m.maxFillRate.Store(defaultMaxFillRate)
+	m.growthBits.Store(math.Float64bits(defaultGrowthFactor))
+	m.defaultSize = size
+	m.setDefaultHasher()
+}
+
+// loadAllocated returns the current metadata, allocating the default sized index first if the map was created lazily
+func (m *Map[K, V]) loadAllocated() *metadata[K, V] {
+	for {
+		if data := m.metadata.Load(); data != nil {
+			return data
+		}
+		m.allocate(m.defaultSize)
+		m.WaitResize()
+	}
+}
+
 // allocate map with the given size
 func (m *Map[K, V]) allocate(newSize uintptr) {
 	if m.resizing.CompareAndSwap(notResizing, resizingInProgress) {
@@ -428,10 +1996,205 @@ func (m *Map[K, V]) fillIndexItems(mapData *metadata[K, V]) {
 	}
 }
 
-// removeItemFromIndex removes an item from the map index
-func (m *Map[K, V]) removeItemFromIndex(item *element[K, V]) {
+// indexItem adds an item already linked in the list to the map index
+// returns the metadata the item was finally indexed in along with the new item counter of that metadata
+//
+// Handshake with grow():-
+// grow() re-indexes the list via fillIndexItems() into a new metadata, stores it and only then clears the resizing flag
+// An item linked in the list after fillIndexItems() has passed its position would be missing from the new metadata
+// hence the item is re-indexed until the resizing flag is clear and the metadata it was indexed in is the latest one
+// Any resize starting after this check traverses a list which already contains the item
+func (m *Map[K, V]) indexItem(data *metadata[K, V], item *element[K, V]) (*metadata[K, V], uintptr) {
+	if data == nil {
+		data = m.loadAllocated()
+	}
 	for {
-		data := m.metadata.Load()
+		if item.isDeleted() {
+			// e.g. an element which got linked into a list detached by Drain(), it must not be indexed in the new index
+			return data, 0
+		}
+		count := data.addItemToIndex(item)
+		if m.resizing.Load() == notResizing && data == m.metadata.Load() {
+			return data, count
+		}
+		m.WaitResize()
+		data = m.metadata.Load()
+	}
+}
+
+// markExpiring records that the map holds entries with a TTL before the first one gets stored
+func (m *Map[K, V]) markExpiring() {
+	if m.expiring.Load() == 0 {
+		m.expiring.Store(1)
+	}
+}
+
+// set is the common implementation of all the insertion methods
+// stores the value along with its expiry (0 for none) and returns the element holding it, whether it was newly inserted and whether the value was stored
+// if overwrite is false then an existing unexpired value is left untouched which lets concurrent GetOrSet() calls agree on a single value
+// If a resizing operation is happening concurrently then it waits for it to finish
+// and indexes the item in the new metadata before returning
+func (m *Map[K, V]) set(key K, valPtr *V, expiry int64, overwrite bool) (alloc *element[K, V], created, stored bool) {
+	alloc, created, stored, _ = m.insert(key, valPtr, expiry, overwrite)
+	return
+}
+
+// copyItem sets the key-value pair of an element of another map keeping its expiry
+func (m *Map[K, V]) copyItem(item *element[K, V]) {
+	box := item.value.Load()
+	m.set(item.key, &box.value, box.expiry, true)
+}
+
+// insert is set which additionally reports whether the insertion triggered a resize
+func (m *Map[K, V]) insert(key K, valPtr *V, expiry int64, overwrite bool) (alloc *element[K, V], created, stored, resized bool) {
+	var (
+		h        = m.hasher(key)
+		data     = m.metadata.Load()
+		existing = data.indexElement(h)
+	)
+
+	if existing == nil || existing.keyHash > h {
+		existing = m.listHead
+	}
+	if expiry != 0 {
+		m.markExpiring()
+	}
+	m.beginWrite()
+	if alloc, created, stored = existing.inject(h, key, valPtr, expiry, overwrite); alloc == nil {
+		for attempt := uint32(1); alloc == nil; attempt++ {
+			backoff(attempt)
+			existing = m.listHead
+			alloc, created, stored = existing.inject(h, key, valPtr, expiry, overwrite)
+		}
+	}
+	m.endWrite()
+	if mt := m.metrics.Load(); mt != nil {
+		m.countCollision(mt, existing, alloc)
+	}
+	if stored {
+		resized = m.completeSet(data, alloc, created)
+	}
+	return
+}
+
+// countCollision counts an insertion whose search from `from` walked past an element of another key in the index slot of `to`
+// the path is walked again which is only paid for if metrics are enabled
+func (m *Map[K, V]) countCollision(mt *metrics, from, to *element[K, V]) {
+	data := m.metadata.Load()
+	if data == nil {
+		return
+	}
+	slot := to.keyHash >> data.keyshifts
+	for elem := from; elem != nil && elem != to && elem.keyHash <= to.keyHash; elem = elem.next() {
+		if elem != m.listHead && elem.keyHash>>data.keyshifts == slot {
+			mt.collisions.Add(1)
+			return
+		}
+	}
+}
+
+// completeSet finishes an insertion after the element got linked in the list or had its value updated
+// accounts for newly created elements, indexes the element and triggers a resize if required
+// returns true if the resize was triggered and performed by this call
+func (m *Map[K, V]) completeSet(data *metadata[K, V], alloc *element[K, V], created bool) bool {
+	m.accountSet(alloc, created)
+	data, count := m.indexItem(data, alloc)
+	if count == 0 && created {
+		// the slot was occupied already, check the fill rate anyway as TrySet() might have crossed it without growing
+		count = data.count.Load()
+	}
+	if m.fixedSize.Load() == 0 && m.resizeNeeded(uintptr(len(data.index)), count) && m.resizing.CompareAndSwap(notResizing, resizingInProgress) {
+		m.grow(0) // double in size
+		return true
+	}
+	return false
+}
+
+// accountSet records the write of a stored element and accounts for a newly created element
+func (m *Map[K, V]) accountSet(alloc *element[K, V], created bool) {
+	if wl := m.writeLog.Load(); wl != nil {
+		wl.record(LogSet, alloc.key)
+	}
+	if created {
+		m.incrementItems(alloc)
+	}
+}
+
+// RemoveExpired deletes all the entries whose TTL has elapsed and returns the number of deleted entries
+func (m *Map[K, V]) RemoveExpired() (removed uintptr) {
+	for item := m.listHead.next(); item != nil; item = item.next() {
+		if item.isExpired() && m.removeElement(item) {
+			m.removeItemFromIndex(item, true)
+			removed++
+		}
+	}
+	return
+}
+
+// DeleteHashRange deletes all the keys whose hashes lie within the inclusive range [lo, hi]
+// As the list is sorted by key hashes the keys form a contiguous segment which is found via the index
+// so the cost is proportional to the size of the range instead of the size of the map
+func (m *Map[K, V]) DeleteHashRange(lo, hi uintptr) {
+	if lo > hi {
+		return
+	}
+	for item := m.metadata.Load().indexElement(lo); item != nil && item.keyHash <= hi; item = item.next() {
+		if item.keyHash >= lo && m.removeElement(item) {
+			m.removeItemFromIndex(item, true)
+		}
+	}
+}
+
+// RemoveWhile deletes the entries in ascending order of key hashes for as long as `pred` returns true
+// and stops at the first entry for which it returns false, returning the number of deleted entries
+// Unlike a full scan this only visits the removed prefix of the list plus one entry
+func (m *Map[K, V]) RemoveWhile(pred func(K, V) bool) (removed uintptr) {
+	for item := m.listHead.nextLive(); item != nil && pred(item.key, item.value.Load().value); item = item.nextLive() {
+		if m.removeElement(item) {
+			m.removeItemFromIndex(item, true)
+			removed++
+		}
+	}
+	return
+}
+
+// incrementItems increments the item counter after a new element got inserted
+// for bounded maps an entry gets evicted if the counter went above the bound
+func (m *Map[K, V]) incrementItems(alloc *element[K, V]) {
+	if m.order != nil {
+		m.order.push(alloc)
+	}
+	if count := m.numItems.Add(1); m.maxItems > 0 && count > m.maxItems {
+		m.evict(alloc)
+	}
+}
+
+// evict removes the element with the smallest key hash other than `keep` and passes it to the eviction callback
+func (m *Map[K, V]) evict(keep *element[K, V]) {
+	for item := m.listHead.next(); item != nil; item = item.next() {
+		if item != keep && m.removeElement(item) {
+			m.removeItemFromIndex(item, true)
+			if m.onEvict != nil {
+				m.onEvict(item.key, item.value.Load().value)
+			}
+			return
+		}
+	}
+}
+
+// removeItemFromIndex removes an item from the map index
+// `removed` is the result of the caller's remove() on the item, only the caller which marked the item as deleted
+// accounts for it in the item counter so that concurrent deletions of the same item cannot underflow the counter
+func (m *Map[K, V]) removeItemFromIndex(item *element[K, V], removed bool) {
+	if removed && m.order != nil {
+		m.order.unlink(item)
+	}
+	if wl := m.writeLog.Load(); removed && wl != nil {
+		wl.record(LogDel, item.key)
+	}
+	for attempt := uint32(0); ; attempt++ {
+		backoff(attempt)
+		data := m.loadAllocated()
 		index := item.keyHash >> data.keyshifts
 		ptr := (*unsafe.Pointer)(unsafe.Pointer(uintptr(data.data) + index*intSizeBytes))
 
@@ -442,8 +2205,10 @@ func (m *Map[K, V]) removeItemFromIndex(item *element[K, V]) {
 		swappedToNil := atomic.CompareAndSwapPointer(ptr, unsafe.Pointer(item), unsafe.Pointer(next)) && next == nil
 
 		if data == m.metadata.Load() { // check that no resize happened
-			m.numItems.Add(^uintptr(0)) // decrement counter
-			if swappedToNil {           // decrement the metadata count if the index is set to nil
+			if removed {
+				m.numItems.Add(^uintptr(0)) // decrement counter
+			}
+			if swappedToNil { // decrement the metadata count if the index is set to nil
 				data.count.Add(^uintptr(0))
 			}
 			return
@@ -453,36 +2218,73 @@ func (m *Map[K, V]) removeItemFromIndex(item *element[K, V]) {
 
 // grow to the new size
 func (m *Map[K, V]) grow(newSize uintptr) {
+	var oldSize uintptr // zero for the initial allocation
+	if data := m.metadata.Load(); data != nil {
+		oldSize = uintptr(len(data.index))
+	}
 	for {
 		currentStore := m.metadata.Load()
-		if newSize == 0 {
-			newSize = uintptr(len(currentStore.index)) << 1
+		if newSize == 0 && currentStore == nil {
+			newSize = roundUpPower2(m.defaultSize)
+		} else if newSize == 0 {
+			newSize = m.grownSize(uintptr(len(currentStore.index)))
 		} else {
 			newSize = roundUpPower2(newSize)
 		}
 
-		index := make([]*element[K, V], newSize)
-		header := (*reflect.SliceHeader)(unsafe.Pointer(&index))
-
-		newdata := &metadata[K, V]{
-			keyshifts: strconv.IntSize - log2(newSize),
-			data:      unsafe.Pointer(header.Data),
-			index:     index,
-		}
-
+		newdata := m.newMetadata(newSize)
 		m.fillIndexItems(newdata) // re-index with longer and more widespread keys
 		m.metadata.Store(newdata)
 
-		if !resizeNeeded(newSize, uintptr(m.Len())) {
+		if m.fixedSize.Load() == 1 || !m.resizeNeeded(newSize, uintptr(m.Len())) {
 			m.resizing.Store(notResizing)
+			m.resizes.Add(1)
+			// invoked after the resizing flag is released so that the callback can safely use the map
+			if cb := m.onResize.Load(); cb != nil {
+				(*cb)(oldSize, newSize)
+			}
 			return
 		}
 		newSize = 0 // 0 means double the current size
 	}
 }
 
-// indexElement returns the index of a hash key, returns `nil` if absent
+// newMetadata returns an empty index of the given size for the list of the map
+func (m *Map[K, V]) newMetadata(size uintptr) *metadata[K, V] {
+	index := make([]*element[K, V], size)
+	header := (*reflect.SliceHeader)(unsafe.Pointer(&index))
+	return &metadata[K, V]{
+		keyshifts: strconv.IntSize - log2(size),
+		data:      unsafe.Pointer(header.Data),
+		listHead:  m.listHead,
+		index:     index,
+	}
+}
+
+// grownSize returns the size the index of the given length grows to as per the growth factor
+func (m *Map[K, V]) grownSize(length uintptr) uintptr {
+	size := math.Ceil(float64(length) * math.Float64frombits(m.growthBits.Load()))
+	if size >= maxIndexSize {
+		return maxIndexSize
+	}
+	return roundUpPower2(uintptr(size))
+}
+
+// size returns the number of slots of the index, 0 for a lazily created map which has no index yet
+func (md *metadata[K, V]) size() uintptr {
+	if md == nil {
+		return 0
+	}
+	return uintptr(len(md.index))
+}
+
+// indexElement returns the closest indexed element preceding a hash key
+// falls back to the first live element of the list if no valid index precedes the hash key, returns `nil` if the list is empty
+// or if the map was created lazily and has no index yet
 func (md *metadata[K, V]) indexElement(hashedKey uintptr) *element[K, V] {
+	if md == nil {
+		return nil
+	}
 	index := hashedKey >> md.keyshifts
 	ptr := (*unsafe.Pointer)(unsafe.Pointer(uintptr(md.data) + index*intSizeBytes))
 	item := (*element[K, V])(atomic.LoadPointer(ptr))
@@ -491,6 +2293,10 @@ func (md *metadata[K, V]) indexElement(hashedKey uintptr) *element[K, V] {
 		ptr = (*unsafe.Pointer)(unsafe.Pointer(uintptr(md.data) + index*intSizeBytes))
 		item = (*element[K, V])(atomic.LoadPointer(ptr))
 	}
+	if item == nil || hashedKey < item.keyHash || item.isDeleted() {
+		// the list head itself is not returned as its zero key could match a lookup
+		return md.listHead.next()
+	}
 	return item
 }
 
@@ -516,26 +2322,46 @@ func (md *metadata[K, V]) addItemToIndex(item *element[K, V]) uintptr {
 }
 
 // check if resize is needed
-func resizeNeeded(length, count uintptr) bool {
-	return (count*100)/length > maxFillRate
+func (m *Map[K, V]) resizeNeeded(length, count uintptr) bool {
+	return (count*100)/length > m.maxFillRate.Load()
 }
 
 // roundUpPower2 rounds a number to the next power of 2
+// the result is at least 1 and at most maxIndexSize, so that it can neither overflow to 0 nor exceed the width of uintptr
 func roundUpPower2(i uintptr) uintptr {
-	i--
-	i |= i >> 1
-	i |= i >> 2
-	i |= i >> 4
-	i |= i >> 8
-	i |= i >> 16
-	i |= i >> 32
-	i++
-	return i
+	if i > maxIndexSize {
+		return maxIndexSize
+	}
+	if i <= 1 {
+		return 1
+	}
+	return 1 << bits.Len(uint(i-1))
 }
 
 // log2 computes the binary logarithm of x, rounded up to the next integer
-func log2(i uintptr) (n uintptr) {
-	for p := uintptr(1); p < i; p, n = p<<1, n+1 {
+func log2(i uintptr) uintptr {
+	if i <= 1 {
+		return 0
 	}
-	return
+	return uintptr(bits.Len(uint(i - 1)))
+}
+
+// jsonKey returns the JSON object key of a map key as encoded by encoding/json
+func jsonKey[K hashable](key K) (string, error) {
+	v := reflect.ValueOf(key)
+	switch v.Kind() {
+	case reflect.String:
+		return v.String(), nil
+	}
+	if tm, ok := any(key).(encoding.TextMarshaler); ok {
+		b, err := tm.MarshalText()
+		return string(b), err
+	}
+	switch v.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return strconv.FormatInt(v.Int(), 10), nil
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		return strconv.FormatUint(v.Uint(), 10), nil
+	}
+	return "", &json.UnsupportedTypeError{Type: v.Type()}
 }
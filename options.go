@@ -0,0 +1,85 @@
+package haxmap
+
+type (
+	// Option configures a map created via NewWithOptions
+	Option[K hashable, V any] func(*config[K, V])
+
+	// configuration of a map applied at creation
+	config[K hashable, V any] struct {
+		size        uintptr
+		hasher      func(K) uintptr
+		maxFillRate uintptr
+		ordered     bool
+		readViews   bool
+		lazy        bool
+	}
+)
+
+// NewWithOptions returns a new HashMap instance configured by the given options
+func NewWithOptions[K hashable, V any](opts ...Option[K, V]) *Map[K, V] {
+	cfg := config[K, V]{size: defaultSize, maxFillRate: defaultMaxFillRate}
+	for _, opt := range opts {
+		opt(&cfg)
+	}
+	m := new(Map[K, V])
+	if cfg.lazy {
+		m.initLazy(cfg.size)
+	} else {
+		m.init(cfg.size)
+	}
+	m.SetMaxFillRate(cfg.maxFillRate)
+	if cfg.hasher != nil {
+		m.storeHasher(cfg.hasher)
+	}
+	m.requireHasher()
+	if cfg.ordered {
+		m.order = newInsertionOrder[K, V]()
+	}
+	if cfg.readViews {
+		m.views = new(readViews[K, V])
+	}
+	return m
+}
+
+// WithInitialSize sets the initialization size of the map, gets rounded up to next power of 2
+// The default size is used if size is 0
+func WithInitialSize[K hashable, V any](size uintptr) Option[K, V] {
+	return func(cfg *config[K, V]) {
+		if size > 0 {
+			cfg.size = size
+		}
+	}
+}
+
+// WithHasher sets the hash function of the map to the one provided by the user
+// Setting the hasher at creation avoids re-hashing issues of calling SetHasher on a non-empty map
+func WithHasher[K hashable, V any](hasher func(K) uintptr) Option[K, V] {
+	return func(cfg *config[K, V]) {
+		cfg.hasher = hasher
+	}
+}
+
+// WithMaxFillRate sets the fill rate percentage of the map index beyond which the map is resized
+// See SetMaxFillRate for details
+func WithMaxFillRate[K hashable, V any](percent uintptr) Option[K, V] {
+	return func(cfg *config[K, V]) {
+		cfg.maxFillRate = percent
+	}
+}
+
+// WithInsertionOrder enables tracking the insertion order of keys for iteration via ForEachOrdered
+// It is disabled by default as every insertion and deletion has to additionally update the insertion order list under a lock
+func WithInsertionOrder[K hashable, V any]() Option[K, V] {
+	return func(cfg *config[K, V]) {
+		cfg.ordered = true
+	}
+}
+
+// WithReadViews enables opening coherent read-only views of the map via BeginReadView
+// It is disabled by default as every change of the entries has to register with the open views,
+// and the first write after opening views copies all entries (copy-on-write)
+func WithReadViews[K hashable, V any]() Option[K, V] {
+	return func(cfg *config[K, V]) {
+		cfg.readViews = true
+	}
+}
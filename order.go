@@ -0,0 +1,88 @@
+package haxmap
+
+import "sync"
+
+// insertionOrder is a doubly linked list threading the elements of a map in order of insertion
+// It is only maintained for maps created with the WithInsertionOrder option
+//
+// Writers append and unlink nodes under a mutex whereas readers traverse the `next` pointers atomically without locking
+// An unlinked node keeps its `next` pointer so that a reader positioned on it can continue its traversal
+//
+// Cost:- the order nodes are kept in a side table so that elements of unordered maps carry no extra field,
+// every insertion/deletion in an ordered map allocates/unlinks an order node and updates the table under the mutex
+type insertionOrder[K hashable, V any] struct {
+	mu    sync.Mutex
+	head  *orderNode[K, V] // sentinel node
+	tail  *orderNode[K, V]
+	nodes map[*element[K, V]]*orderNode[K, V] // order node of every element in the list, protected by the mutex
+}
+
+// a single node in the insertion order list
+type orderNode[K hashable, V any] struct {
+	elem *element[K, V]
+	next atomicPointer[orderNode[K, V]]
+	prev *orderNode[K, V] // protected by the mutex
+}
+
+// newInsertionOrder returns a new empty insertion order list
+func newInsertionOrder[K hashable, V any]() *insertionOrder[K, V] {
+	o := new(insertionOrder[K, V])
+	o.reset()
+	return o
+}
+
+// reset empties the list
+func (o *insertionOrder[K, V]) reset() {
+	o.mu.Lock()
+	o.head = new(orderNode[K, V])
+	o.tail = o.head
+	o.nodes = make(map[*element[K, V]]*orderNode[K, V])
+	o.mu.Unlock()
+}
+
+// push appends a newly inserted element to the list
+// elements deleted before getting appended are skipped
+func (o *insertionOrder[K, V]) push(elem *element[K, V]) {
+	o.mu.Lock()
+	if _, ok := o.nodes[elem]; !ok && !elem.isDeleted() {
+		node := &orderNode[K, V]{elem: elem, prev: o.tail}
+		o.tail.next.Store(node)
+		o.tail = node
+		o.nodes[elem] = node
+	}
+	o.mu.Unlock()
+}
+
+// unlink removes a deleted element from the list
+func (o *insertionOrder[K, V]) unlink(elem *element[K, V]) {
+	o.mu.Lock()
+	if node, ok := o.nodes[elem]; ok {
+		delete(o.nodes, elem)
+		next := node.next.Load()
+		node.prev.next.Store(next)
+		if next != nil {
+			next.prev = node.prev
+		} else if o.tail == node {
+			o.tail = node.prev
+		}
+	}
+	o.mu.Unlock()
+}
+
+// move hands the order node of an element over to its replacement, keeping its position in the list
+func (o *insertionOrder[K, V]) move(from, to *element[K, V]) {
+	o.mu.Lock()
+	if node, ok := o.nodes[from]; ok {
+		delete(o.nodes, from)
+		node.elem = to
+		o.nodes[to] = node
+	}
+	o.mu.Unlock()
+}
+
+// first returns the first node of the list
+func (o *insertionOrder[K, V]) first() *orderNode[K, V] {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	return o.head.next.Load()
+}
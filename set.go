@@ -0,0 +1,87 @@
+package haxmap
+
+// HashSet implements a concurrent set on top of a map with empty values
+type HashSet[K hashable] struct {
+	m *Map[K, struct{}]
+}
+
+// NewHashSet returns a new HashSet instance with an optional specific initialization size
+func NewHashSet[K hashable](size ...uintptr) *HashSet[K] {
+	return &HashSet[K]{m: New[K, struct{}](size...)}
+}
+
+// Add inserts the key into the set
+func (s *HashSet[K]) Add(key K) {
+	s.m.Set(key, struct{}{})
+}
+
+// Remove deletes the key from the set
+func (s *HashSet[K]) Remove(key K) {
+	s.m.Del(key)
+}
+
+// Has reports whether the key is present in the set
+func (s *HashSet[K]) Has(key K) bool {
+	_, ok := s.m.Get(key)
+	return ok
+}
+
+// Len returns the number of keys within the set
+func (s *HashSet[K]) Len() uintptr {
+	return s.m.Len()
+}
+
+// ForEach iterates over the keys of the set and executes the lambda provided for each key
+// lambda must return `true` to continue iteration and `false` to break iteration
+func (s *HashSet[K]) ForEach(lambda func(K) bool) {
+	s.m.ForEachKey(lambda)
+}
+
+// Union returns a new set containing the keys present in either set
+func (s *HashSet[K]) Union(other *HashSet[K]) *HashSet[K] {
+	result := s.derive(s.Len() + other.Len())
+	s.ForEach(func(key K) bool {
+		result.Add(key)
+		return true
+	})
+	other.ForEach(func(key K) bool {
+		result.Add(key)
+		return true
+	})
+	return result
+}
+
+// Intersect returns a new set containing the keys present in both sets
+func (s *HashSet[K]) Intersect(other *HashSet[K]) *HashSet[K] {
+	small, large := s, other
+	if large.Len() < small.Len() {
+		small, large = large, small
+	}
+	result := s.derive(small.Len())
+	small.ForEach(func(key K) bool {
+		if large.Has(key) {
+			result.Add(key)
+		}
+		return true
+	})
+	return result
+}
+
+// Difference returns a new set containing the keys present in this set but not in the other one
+func (s *HashSet[K]) Difference(other *HashSet[K]) *HashSet[K] {
+	result := s.derive(s.Len())
+	s.ForEach(func(key K) bool {
+		if !other.Has(key) {
+			result.Add(key)
+		}
+		return true
+	})
+	return result
+}
+
+// derive returns an empty set with the same hash function as this set which can hold `count` keys without resizing
+func (s *HashSet[K]) derive(count uintptr) *HashSet[K] {
+	result := &HashSet[K]{m: NewWithOptions(WithHasher[K, struct{}](s.m.loadHasher()))}
+	result.m.Reserve(count)
+	return result
+}
@@ -0,0 +1,199 @@
+package haxmap
+
+import "fmt"
+
+// CoreMap is the subset of the API shared by Map and SingleThreadedMap
+// Code written against it can switch between both implementations depending on whether the map is shared between goroutines
+type CoreMap[K hashable, V any] interface {
+	Get(key K) (value V, ok bool)
+	Set(key K, value V)
+	GetOrSet(key K, value V) (actual V, loaded bool)
+	Del(keys ...K)
+	Len() uintptr
+	ForEach(lambda func(K, V) bool)
+	Clear()
+	SetHasher(hs func(K) uintptr)
+}
+
+var (
+	_ CoreMap[int, int] = (*Map[int, int])(nil)
+	_ CoreMap[int, int] = (*SingleThreadedMap[int, int])(nil)
+)
+
+// SingleThreadedMap is a hashmap backed by an open-addressing table with linear probing
+// It uses plain loads and stores instead of atomic operations and a lock-free list, which makes it faster for maps
+// confined to a single goroutine. It is NOT safe for concurrent use, not even for concurrent reads during a write
+// It only implements the core API of Map as defined by CoreMap, the rest of the methods of Map such as TTLs,
+// compare-and-swap, iteration in order or JSON encoding are not available
+type SingleThreadedMap[K hashable, V any] struct {
+	hasher  func(K) uintptr
+	slots   []slot[K, V]
+	mask    uintptr // len(slots) - 1
+	count   uintptr // number of live entries
+	deleted uintptr // number of tombstones
+}
+
+// states of a slot of a SingleThreadedMap
+const (
+	slotEmpty uint8 = iota
+	slotFull
+	slotDeleted // tombstone keeping probe sequences intact after a deletion
+)
+
+// a single slot of a SingleThreadedMap
+type slot[K hashable, V any] struct {
+	keyHash uintptr
+	key     K
+	value   V
+	state   uint8
+}
+
+// NewSingleThreaded returns a new SingleThreadedMap instance with an optional specific initialization size
+// The size gets rounded up to the next power of 2
+func NewSingleThreaded[K hashable, V any](size ...uintptr) *SingleThreadedMap[K, V] {
+	n := uintptr(defaultSize)
+	if len(size) > 0 && size[0] > 0 {
+		n = size[0]
+	}
+	hasher := DefaultHasher[K]()
+	if hasher == nil {
+		panic(fmt.Sprintf("haxmap: no default hasher for key type %T", *new(K)))
+	}
+	m := &SingleThreadedMap[K, V]{hasher: hasher}
+	m.allocate(roundUpPower2(n))
+	return m
+}
+
+// SetHasher sets the hash function to the one provided by the user, existing entries are re-hashed
+func (m *SingleThreadedMap[K, V]) SetHasher(hs func(K) uintptr) {
+	m.hasher = hs
+	m.rehash(uintptr(len(m.slots)))
+}
+
+// Get retrieves an element from the map
+// returns `false“ if element is absent
+func (m *SingleThreadedMap[K, V]) Get(key K) (value V, ok bool) {
+	if i, found := m.find(key, m.hasher(key)); found {
+		return m.slots[i].value, true
+	}
+	return
+}
+
+// Set tries to update an element if key is present else it inserts a new element
+func (m *SingleThreadedMap[K, V]) Set(key K, value V) {
+	h := m.hasher(key)
+	i, found := m.find(key, h)
+	if !found {
+		i = m.claim(i, h, key)
+	}
+	m.slots[i].value = value
+}
+
+// GetOrSet returns the existing value for the key if present
+// Otherwise, it stores and returns the given value
+// The loaded result is true if the value was loaded, false if stored
+func (m *SingleThreadedMap[K, V]) GetOrSet(key K, value V) (actual V, loaded bool) {
+	h := m.hasher(key)
+	i, found := m.find(key, h)
+	if found {
+		return m.slots[i].value, true
+	}
+	i = m.claim(i, h, key)
+	m.slots[i].value = value
+	return value, false
+}
+
+// Del deletes the key-value pairs of the given keys
+func (m *SingleThreadedMap[K, V]) Del(keys ...K) {
+	for _, key := range keys {
+		if i, found := m.find(key, m.hasher(key)); found {
+			m.slots[i] = slot[K, V]{state: slotDeleted}
+			m.count--
+			m.deleted++
+		}
+	}
+}
+
+// Len returns the number of key-value pairs within the map
+func (m *SingleThreadedMap[K, V]) Len() uintptr {
+	return m.count
+}
+
+// ForEach iterates over key-value pairs and executes the lambda provided for each such pair
+// lambda must return `true` to continue iteration and `false` to break iteration
+// Pairs are visited in slot order, the lambda must not modify the map
+func (m *SingleThreadedMap[K, V]) ForEach(lambda func(K, V) bool) {
+	for i := range m.slots {
+		if s := &m.slots[i]; s.state == slotFull && !lambda(s.key, s.value) {
+			return
+		}
+	}
+}
+
+// Clear removes all entries and resets the table to its initial size
+func (m *SingleThreadedMap[K, V]) Clear() {
+	m.allocate(defaultSize)
+}
+
+// find returns the slot holding the key if found
+// otherwise it returns the first reusable slot of the probe sequence which is where the key would be inserted
+func (m *SingleThreadedMap[K, V]) find(key K, h uintptr) (uintptr, bool) {
+	reusable, hasReusable := uintptr(0), false
+	for i := h & m.mask; ; i = (i + 1) & m.mask {
+		switch s := &m.slots[i]; s.state {
+		case slotEmpty:
+			if hasReusable {
+				return reusable, false
+			}
+			return i, false
+		case slotDeleted:
+			if !hasReusable {
+				reusable, hasReusable = i, true
+			}
+		default:
+			if s.keyHash == h && s.key == key {
+				return i, true
+			}
+		}
+	}
+}
+
+// claim stores the key in the free slot `i` returned by find, resizing first if required, and returns the final slot
+func (m *SingleThreadedMap[K, V]) claim(i, h uintptr, key K) uintptr {
+	// keep at least a quarter of the slots empty so that probe sequences stay short and always terminate
+	if (m.count+m.deleted+1)*4 > uintptr(len(m.slots))*3 {
+		size := uintptr(len(m.slots))
+		if (m.count+1)*2 > size {
+			size *= 2 // otherwise only the tombstones are dropped at the same size
+		}
+		m.rehash(size)
+		i, _ = m.find(key, h)
+	}
+	if m.slots[i].state == slotDeleted {
+		m.deleted--
+	}
+	m.slots[i] = slot[K, V]{keyHash: h, key: key, state: slotFull}
+	m.count++
+	return i
+}
+
+// rehash moves all live entries into a new table of the given size
+func (m *SingleThreadedMap[K, V]) rehash(size uintptr) {
+	old := m.slots
+	m.allocate(size)
+	for i := range old {
+		if s := &old[i]; s.state == slotFull {
+			h := m.hasher(s.key)
+			j, _ := m.find(s.key, h)
+			m.slots[j] = slot[K, V]{keyHash: h, key: s.key, value: s.value, state: slotFull}
+			m.count++
+		}
+	}
+}
+
+// allocate replaces the table with an empty one of the given size
+func (m *SingleThreadedMap[K, V]) allocate(size uintptr) {
+	m.slots = make([]slot[K, V], size)
+	m.mask = size - 1
+	m.count, m.deleted = 0, 0
+}
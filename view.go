@@ -0,0 +1,206 @@
+package haxmap
+
+import (
+	"runtime"
+	"sync"
+)
+
+// readViews tracks the read views of a map created with the WithReadViews option
+//
+// Opening a view copies nothing, the view reads the map itself until the first write after its opening copies the
+// entries (copy-on-write). Every change of the entries is bracketed by beginWrite() and endWrite(), so that this write
+// waits for the writers in progress and copies the entries before any change after the opening gets published.
+// The copy shares the immutable value boxes of the elements, hence it costs a map entry per key but no copies of values
+//
+// Cost:- writers of maps with read views register themselves via two atomic adds on a shared counter per change
+// and the first write after the opening of views blocks all writers while the entries are copied.
+// Writers of maps without read views only pay a nil check per change
+type readViews[K hashable, V any] struct {
+	mu      sync.Mutex        // serializes opening, closing and copying
+	writers atomicUintptr     // writers publishing a change right now
+	pending atomicUint32      // 1 while views wait for their copy of the entries
+	views   []*ReadView[K, V] // views without a copy of the entries, protected by the mutex
+}
+
+// ReadView is a read-only view of the entries of a map at the time it was opened via BeginReadView
+// Its readers see a coherent state no matter how the map is modified concurrently
+type ReadView[K hashable, V any] struct {
+	m       *Map[K, V]
+	entries atomicPointer[map[K]*valueBox[V]] // copy of the entries, nil until the first write after the opening
+}
+
+// open registers a new view which is frozen at the time of the call
+func (r *readViews[K, V]) open(m *Map[K, V]) *ReadView[K, V] {
+	view := &ReadView[K, V]{m: m}
+	r.mu.Lock()
+	r.pending.Store(1)
+	// writers which registered before noticing the pending view publish their changes before the opening
+	for r.writers.Load() != 0 {
+		runtime.Gosched()
+	}
+	r.views = append(r.views, view)
+	r.mu.Unlock()
+	return view
+}
+
+// close unregisters a view and releases its copy of the entries
+func (r *readViews[K, V]) close(view *ReadView[K, V]) {
+	r.mu.Lock()
+	for i, v := range r.views {
+		if v == view {
+			r.views = append(r.views[:i], r.views[i+1:]...)
+			break
+		}
+	}
+	if len(r.views) == 0 {
+		r.pending.Store(0)
+	}
+	view.entries.Store(&map[K]*valueBox[V]{})
+	r.mu.Unlock()
+}
+
+// beginWrite registers a writer which is about to change the entries of the map
+// the entries are copied for pending views first, every call must be followed by a call to endWrite()
+func (r *readViews[K, V]) beginWrite(m *Map[K, V]) {
+	for {
+		r.writers.Add(1)
+		if r.pending.Load() == 0 {
+			return
+		}
+		r.writers.Add(^uintptr(0))
+		r.copyEntries(m)
+	}
+}
+
+// endWrite unregisters a writer once its change got published
+func (r *readViews[K, V]) endWrite() {
+	r.writers.Add(^uintptr(0))
+}
+
+// copyEntries hands a copy of the entries to all pending views unless another writer did so already
+// new writers wait for the mutex, the copy is taken once the writers in progress published their changes
+func (r *readViews[K, V]) copyEntries(m *Map[K, V]) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if len(r.views) == 0 {
+		return
+	}
+	for r.writers.Load() != 0 {
+		runtime.Gosched()
+	}
+	entries := make(map[K]*valueBox[V], m.Len())
+	for item := m.listHead.next(); item != nil; item = item.next() {
+		entries[item.key] = item.value.Load()
+	}
+	for _, view := range r.views {
+		view.entries.Store(&entries)
+	}
+	r.views = nil
+	r.pending.Store(0)
+}
+
+// BeginReadView opens a read-only view of the map frozen at the time of the call, for readers which must see
+// a coherent state while writers continue. The map must have been created with the WithReadViews option
+//
+// Opening a view is cheap, the view reads the map itself until the first write after the opening copies all entries
+// for the views opened in the meantime. The copy holds a map entry per key and keeps the values alive until the view
+// is closed. Expiring entries stay part of the view but are treated as absent once their TTL elapsed
+// The view should be released via Close() once done
+func (m *Map[K, V]) BeginReadView() *ReadView[K, V] {
+	if m.views == nil {
+		panic("haxmap: BeginReadView requires a map created with the WithReadViews option")
+	}
+	return m.views.open(m)
+}
+
+// beginWrite must precede every change of the entries of the map, so that read views get their copy of the entries first
+// It is a single nil check unless read views are enabled, every call must be followed by a call to endWrite()
+// No callbacks of users may run between both calls, as a nested write would wait for the outer one to finish
+func (m *Map[K, V]) beginWrite() {
+	if m.views != nil {
+		m.views.beginWrite(m)
+	}
+}
+
+// endWrite follows every beginWrite() once the change got published
+func (m *Map[K, V]) endWrite() {
+	if m.views != nil {
+		m.views.endWrite()
+	}
+}
+
+// removeElement marks an element deleted as a change of the entries, see beginWrite()
+func (m *Map[K, V]) removeElement(item *element[K, V]) bool {
+	m.beginWrite()
+	removed := item.remove()
+	m.endWrite()
+	return removed
+}
+
+// compareAndSwapValue swaps in a new value for an element as a change of the entries, see beginWrite()
+func (m *Map[K, V]) compareAndSwapValue(item *element[K, V], old *valueBox[V], new *V) bool {
+	m.beginWrite()
+	swapped := item.compareAndSwapValue(old, new)
+	m.endWrite()
+	return swapped
+}
+
+// Get retrieves an element from the view
+// returns `false` if element is absent, reading from a closed view always returns false
+func (v *ReadView[K, V]) Get(key K) (value V, ok bool) {
+	if entries := v.entries.Load(); entries != nil {
+		return lookupEntry(*entries, key)
+	}
+	value, ok = v.m.Get(key)
+	// every write after the opening copies the entries before its change, hence if the lookup observed such a write
+	// then the copy is present by now
+	if entries := v.entries.Load(); entries != nil {
+		return lookupEntry(*entries, key)
+	}
+	return
+}
+
+// ForEach iterates over the key-value pairs of the view in no particular order
+// lambda must return `true` to continue iteration and `false` to break iteration
+func (v *ReadView[K, V]) ForEach(lambda func(K, V) bool) {
+	entries := v.entries.Load()
+	if entries == nil {
+		// the pairs are collected before calling the lambda as a write during the traversal might have been observed
+		pairs := v.m.Snapshot()
+		if entries = v.entries.Load(); entries == nil {
+			for _, pair := range pairs {
+				if !lambda(pair.Key, pair.Value) {
+					return
+				}
+			}
+			return
+		}
+	}
+	for key, box := range *entries {
+		if !box.isExpired() && !lambda(key, box.value) {
+			return
+		}
+	}
+}
+
+// Len returns the number of key-value pairs within the view, it requires a full traversal of the view
+func (v *ReadView[K, V]) Len() (count int) {
+	v.ForEach(func(K, V) bool {
+		count++
+		return true
+	})
+	return
+}
+
+// Close releases the view along with its copy of the entries, the view is empty afterwards
+func (v *ReadView[K, V]) Close() {
+	v.m.views.close(v)
+}
+
+// lookupEntry retrieves a key from a copy of the entries of a map
+func lookupEntry[K hashable, V any](entries map[K]*valueBox[V], key K) (value V, ok bool) {
+	if box, found := entries[key]; found && !box.isExpired() {
+		value, ok = box.value, true
+	}
+	return
+}
@@ -0,0 +1,63 @@
+//go:build go1.24
+
+package haxmap
+
+import "weak"
+
+// WeakValueMap is a concurrent hashmap holding weak pointers to its values
+// Values which are no longer referenced elsewhere can be reclaimed by the garbage collector
+// after which their entries are treated as deleted, which suits caches of large reconstructable objects
+type WeakValueMap[K hashable, V any] struct {
+	m *Map[K, weak.Pointer[V]]
+}
+
+// NewWeakValueMap returns a new WeakValueMap instance with an optional specific initialization size
+func NewWeakValueMap[K hashable, V any](size ...uintptr) *WeakValueMap[K, V] {
+	return &WeakValueMap[K, V]{m: New[K, weak.Pointer[V]](size...)}
+}
+
+// Set stores a weak pointer to the value under the given key
+func (w *WeakValueMap[K, V]) Set(key K, value *V) {
+	w.m.Set(key, weak.Make(value))
+}
+
+// Get retrieves the value of the key, ok is false if the key is absent or if its value was reclaimed
+func (w *WeakValueMap[K, V]) Get(key K) (value *V, ok bool) {
+	if ptr, found := w.m.Get(key); found {
+		value = ptr.Value()
+	}
+	return value, value != nil
+}
+
+// Del deletes the key-value pairs of the given keys
+func (w *WeakValueMap[K, V]) Del(keys ...K) {
+	w.m.Del(keys...)
+}
+
+// ForEach iterates over the key-value pairs whose values were not reclaimed and executes the lambda provided for each such pair
+// lambda must return `true` to continue iteration and `false` to break iteration
+func (w *WeakValueMap[K, V]) ForEach(lambda func(K, *V) bool) {
+	w.m.ForEach(func(key K, ptr weak.Pointer[V]) bool {
+		if value := ptr.Value(); value != nil {
+			return lambda(key, value)
+		}
+		return true
+	})
+}
+
+// Len returns the number of entries within the map
+// Entries whose values were reclaimed are counted until removed via RemoveCollected
+func (w *WeakValueMap[K, V]) Len() uintptr {
+	return w.m.Len()
+}
+
+// RemoveCollected deletes all the entries whose values were reclaimed and returns the number of deleted entries
+func (w *WeakValueMap[K, V]) RemoveCollected() (removed uintptr) {
+	for item := w.m.listHead.next(); item != nil; item = item.next() {
+		if item.value.Load().value.Value() == nil && w.m.removeElement(item) {
+			w.m.removeItemFromIndex(item, true)
+			removed++
+		}
+	}
+	return
+}
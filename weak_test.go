@@ -0,0 +1,52 @@
+//go:build go1.24
+
+package haxmap
+
+import (
+	"runtime"
+	"testing"
+)
+
+func TestWeakValueMap(t *testing.T) {
+	type blob struct{ data [1 << 10]byte }
+	m := NewWeakValueMap[int, blob]()
+
+	kept := &blob{}
+	kept.data[0] = 1
+	m.Set(1, kept)
+	m.Set(2, &blob{})
+	if v, ok := m.Get(1); !ok || v != kept {
+		t.Fatal("referenced value should be retrievable")
+	}
+
+	runtime.GC()
+	if v, ok := m.Get(1); !ok || v.data[0] != 1 {
+		t.Error("referenced value should survive a garbage collection")
+	}
+	if _, ok := m.Get(2); ok {
+		t.Error("unreferenced value should have been reclaimed")
+	}
+	count := 0
+	m.ForEach(func(key int, _ *blob) bool {
+		if key != 1 {
+			t.Errorf("reclaimed key %d should be skipped", key)
+		}
+		count++
+		return true
+	})
+	if count != 1 {
+		t.Errorf("expected to iterate over a single pair, got %d", count)
+	}
+
+	if m.Len() != 2 {
+		t.Errorf("reclaimed entries should be counted until removed, got %d", m.Len())
+	}
+	if removed := m.RemoveCollected(); removed != 1 || m.Len() != 1 {
+		t.Errorf("expected a single reclaimed entry to be removed, got %d with length %d", removed, m.Len())
+	}
+	m.Del(1)
+	if _, ok := m.Get(1); ok {
+		t.Error("deleted key should be absent")
+	}
+	runtime.KeepAlive(kept)
+}
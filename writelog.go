@@ -0,0 +1,94 @@
+package haxmap
+
+import (
+	"bytes"
+	"runtime"
+	"strconv"
+	"sync"
+)
+
+// LogOp is the kind of a write recorded in the write log of a map
+type LogOp uint8
+
+const (
+	// LogSet is an insertion or an update of a key via Set or one of its variants
+	LogSet LogOp = iota
+	// LogDel is a deletion of a key
+	LogDel
+)
+
+// defaultWriteLogSize is the number of entries retained by a write log enabled without an explicit size
+const defaultWriteLogSize = 1024
+
+// String returns the name of the operation
+func (op LogOp) String() string {
+	switch op {
+	case LogSet:
+		return "set"
+	case LogDel:
+		return "del"
+	}
+	return "LogOp(" + strconv.Itoa(int(op)) + ")"
+}
+
+// LogEntry is a single write recorded in the write log of a map, see EnableWriteLog
+type LogEntry[K hashable] struct {
+	Seq       uint64 // position of the write in the order of all logged writes of the map, starting from 0
+	Op        LogOp
+	Key       K
+	Goroutine uint64 // id of the goroutine which performed the write
+}
+
+// writeLog is a ring buffer retaining the most recent writes of a map
+//
+// Writers record under a mutex which also defines the order of the sequence numbers
+// The goroutine id is parsed from the stack trace header as the runtime does not expose it,
+// which is slow but acceptable as the log is only meant for debugging
+type writeLog[K hashable] struct {
+	mu      sync.Mutex
+	entries []LogEntry[K]
+	seq     uint64 // number of writes recorded so far
+}
+
+// newWriteLog returns an empty write log retaining at most `size` entries
+func newWriteLog[K hashable](size uintptr) *writeLog[K] {
+	return &writeLog[K]{entries: make([]LogEntry[K], size)}
+}
+
+// record appends a write to the log overwriting the oldest entry if the log is full
+func (w *writeLog[K]) record(op LogOp, key K) {
+	gid := goroutineID()
+	w.mu.Lock()
+	w.entries[w.seq%uint64(len(w.entries))] = LogEntry[K]{Seq: w.seq, Op: op, Key: key, Goroutine: gid}
+	w.seq++
+	w.mu.Unlock()
+}
+
+// dump returns a copy of the retained entries from the oldest to the newest
+func (w *writeLog[K]) dump() []LogEntry[K] {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	var (
+		size  = uint64(len(w.entries))
+		first uint64
+	)
+	if w.seq > size {
+		first = w.seq - size
+	}
+	entries := make([]LogEntry[K], 0, w.seq-first)
+	for seq := first; seq < w.seq; seq++ {
+		entries = append(entries, w.entries[seq%size])
+	}
+	return entries
+}
+
+// goroutineID returns the id of the calling goroutine from the header line "goroutine N [...]" of its stack trace
+func goroutineID() uint64 {
+	var buf [64]byte
+	b := bytes.TrimPrefix(buf[:runtime.Stack(buf[:], false)], []byte("goroutine "))
+	if i := bytes.IndexByte(b, ' '); i > 0 {
+		b = b[:i]
+	}
+	id, _ := strconv.ParseUint(string(b), 10, 64)
+	return id
+}